@@ -0,0 +1,108 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zwwhdls/node-device-plugin/plugins"
+)
+
+// resizeRequest asks the run loop to change the number of slots of a device.
+type resizeRequest struct {
+	device string
+	slots  int
+	err    chan error
+}
+
+// newAdminHandler serves the local admin endpoint:
+//
+//	PUT /slots/<device>  with the new number of slots as body
+//	GET /allocations     the devices allocated to each container, by resource
+//
+// The requests are handed over to the run loop, which owns the plugins.
+func newAdminHandler(resizes chan<- resizeRequest, tracker *plugins.PodResourcesTracker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tracker.Allocations())
+	})
+	mux.HandleFunc("/slots/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		device := strings.TrimPrefix(r.URL.Path, "/slots/")
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slots, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid number of slots %q", body), http.StatusBadRequest)
+			return
+		}
+
+		req := resizeRequest{device: device, slots: slots, err: make(chan error, 1)}
+		select {
+		case resizes <- req:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-req.err; err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s resized to %d slots\n", device, slots)
+	})
+	return mux
+}
+
+// serveAdmin serves the admin endpoint on addr until the process exits.
+func serveAdmin(addr string, resizes chan<- resizeRequest, tracker *plugins.PodResourcesTracker) {
+	log.Printf("Starting admin endpoint on %s", addr)
+	if err := http.ListenAndServe(addr, newAdminHandler(resizes, tracker)); err != nil {
+		log.Printf("admin endpoint: %s", err)
+	}
+}
+
+// resizeDevice handles a resizeRequest in the run loop.
+func resizeDevice(managed []*managedPlugin, req resizeRequest) error {
+	for _, p := range managed {
+		if p.device.Name == req.device {
+			if err := p.setOverride(req.slots); err != nil {
+				return err
+			}
+			log.Printf("admin: device %s resized to %d slots", req.device, req.slots)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown device %q", req.device)
+}
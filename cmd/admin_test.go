@@ -0,0 +1,111 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/zwwhdls/node-device-plugin/plugins"
+)
+
+func TestAdminHandler(t *testing.T) {
+	Convey("Test admin endpoint", t, func() {
+		cfg := mustParse(t, "devices: [{name: fuse, fuse: {slots: 10}}, {name: kvm, generic: {resourceName: hdls.me/kvm, devices: [{hostPath: /dev/kvm}], slots: 2}}]")
+		managed := newManagedPlugins(cfg)
+		fuse := &fakePlugin{}
+		managed[0].plugin = fuse
+		managed[0].restart = false
+
+		// the run loop
+		resizes := make(chan resizeRequest)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case req := <-resizes:
+					req.err <- resizeDevice(managed, req)
+				case <-done:
+					return
+				}
+			}
+		}()
+		handler := newAdminHandler(resizes, plugins.NewPodResourcesTracker("", time.Hour))
+		do := func(method, path, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return w
+		}
+
+		Convey("resize", func() {
+			w := do(http.MethodPut, "/slots/fuse", "20\n")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "fuse resized to 20 slots\n")
+			So(fuse.slots, ShouldEqual, 20)
+			So(managed[0].device.Fuse.Slots, ShouldEqual, 20)
+
+			Convey("kept across reloads", func() {
+				managed = reconcile(managed, cfg)
+				So(managed[0].device.Fuse.Slots, ShouldEqual, 20)
+				So(managed[0].restart, ShouldBeFalse)
+			})
+		})
+
+		Convey("unknown device", func() {
+			w := do(http.MethodPut, "/slots/tun", "20")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, `unknown device "tun"`)
+		})
+
+		Convey("device without resizable slots", func() {
+			So(do(http.MethodPut, "/slots/kvm", "4").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("negative slots", func() {
+			w := do(http.MethodPut, "/slots/fuse", "-1")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "slots must be positive")
+			So(managed[0].device.Fuse.Slots, ShouldEqual, 10)
+		})
+
+		Convey("not a number", func() {
+			w := do(http.MethodPut, "/slots/fuse", "many")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "invalid number of slots")
+		})
+
+		Convey("wrong method", func() {
+			w := do(http.MethodGet, "/slots/fuse", "")
+			So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(w.Header().Get("Allow"), ShouldEqual, "PUT, POST")
+			So(do(http.MethodPost, "/allocations", "").Code, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("allocations", func() {
+			w := do(http.MethodGet, "/allocations", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(w.Body.String(), ShouldEqual, "{}\n")
+		})
+	})
+}
@@ -0,0 +1,60 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	initialRetryInterval = time.Second
+	maxRetryInterval     = 2 * time.Minute
+)
+
+// backoff spaces the attempts to serve a plugin after failures: the interval
+// doubles up to maxRetryInterval, with a random jitter of up to half of it so
+// that the plugins of a node do not retry in lockstep.
+type backoff struct {
+	failures int
+	next     time.Time
+}
+
+// fail records a failure and returns the delay before the next attempt.
+func (b *backoff) fail(now time.Time) time.Duration {
+	b.failures++
+	d := initialRetryInterval
+	for i := 1; i < b.failures && d < maxRetryInterval; i++ {
+		d *= 2
+	}
+	if d > maxRetryInterval {
+		d = maxRetryInterval
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	b.next = now.Add(d)
+	return d
+}
+
+// reset allows an immediate attempt, e.g. after kubelet restarted.
+func (b *backoff) reset() {
+	*b = backoff{}
+}
+
+// due tells whether the next attempt can be made at now.
+func (b *backoff) due(now time.Time) bool {
+	return !now.Before(b.next)
+}
@@ -0,0 +1,62 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackoff(t *testing.T) {
+	Convey("Test retry backoff", t, func() {
+		now := time.Now()
+		b := &backoff{}
+		So(b.due(now), ShouldBeTrue)
+
+		Convey("delay doubles with a jitter of up to half of it", func() {
+			d := initialRetryInterval
+			for i := 0; i < 20; i++ {
+				delay := b.fail(now)
+				So(delay, ShouldBeBetweenOrEqual, d/2, d)
+				So(b.next, ShouldEqual, now.Add(delay))
+				So(b.due(now), ShouldBeFalse)
+				So(b.due(b.next), ShouldBeTrue)
+				if d *= 2; d > maxRetryInterval {
+					d = maxRetryInterval
+				}
+			}
+			So(b.failures, ShouldEqual, 20)
+		})
+
+		Convey("delay is capped", func() {
+			for i := 0; i < 1000; i++ {
+				So(b.fail(now), ShouldBeLessThanOrEqualTo, maxRetryInterval)
+			}
+			So(b.fail(now), ShouldBeGreaterThanOrEqualTo, maxRetryInterval/2)
+		})
+
+		Convey("reset", func() {
+			b.fail(now)
+			b.reset()
+			So(b.failures, ShouldEqual, 0)
+			So(b.due(now), ShouldBeTrue)
+			So(b.fail(now), ShouldBeLessThanOrEqualTo, initialRetryInterval)
+		})
+	})
+}
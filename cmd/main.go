@@ -17,23 +17,46 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
+	"github.com/zwwhdls/node-device-plugin/config"
 	"github.com/zwwhdls/node-device-plugin/plugins"
 )
 
 var (
-	mountsAllowed = 5000
-	device        = "fuse"
-	version       = ""
+	mountsAllowed  = 5000
+	devices        = []string{"fuse"}
+	configFile     = ""
+	resourceDomain = plugins.DefaultResourceDomain
+	adminAddr      = ""
+	metricsAddr    = ""
+	healthAddr     = ""
+	podResources   = plugins.DefaultPodResourcesSocket
+	pluginDir      = ""
+	kubeletSocket  = ""
+	version        = ""
+
+	// kubeletPaths are the sockets shared with kubelet, resolved at startup
+	kubeletPaths = plugins.DefaultPaths()
 )
 
+// drainDelay leaves kubelet the time to receive the unhealthy devices before
+// the plugins stop on SIGTERM.
+const drainDelay = 2 * time.Second
+
+// procRoot is where the kubelet process is looked for when detecting its
+// root directory, it is only visible with hostPID.
+const procRoot = "/proc"
+
 var rootCmd = &cobra.Command{
 	Use: "node-device-plugin",
 }
@@ -41,17 +64,52 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(runCmd)
 	runCmd.Flags().IntVar(&mountsAllowed, "fuse_mounts_allowed", 5000, "maximum times the fuse device can be mounted")
-	runCmd.Flags().StringVar(&device, "device", "fuse", "enable fuse or block device plugin")
+	runCmd.Flags().StringSliceVar(&devices, "device", []string{"fuse"}, "comma separated device plugins to enable, e.g. fuse,tun,block")
+	runCmd.Flags().StringVar(&configFile, "config", "", "YAML or JSON config file defining the device plugins, overrides --device and --fuse_mounts_allowed")
+	runCmd.Flags().StringVar(&resourceDomain, "resource-domain", plugins.DefaultResourceDomain, "domain of the advertised resource names, e.g. hdls.me/fuse")
+	runCmd.Flags().StringVar(&pluginDir, "device-plugin-dir", "", "directory of the device plugin sockets, detected from the kubelet --root-dir, /var/lib/kubelet/device-plugins/ otherwise")
+	runCmd.Flags().StringVar(&kubeletSocket, "kubelet-socket", "", "kubelet registration socket, kubelet.sock in --device-plugin-dir when empty")
+	runCmd.Flags().StringVar(&podResources, "pod-resources-socket", plugins.DefaultPodResourcesSocket, "kubelet PodResources socket used to track the allocated devices, in the kubelet root directory by default, disabled when empty")
+	runCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "address of the Prometheus metrics endpoint, e.g. :9090, disabled when empty")
+	runCmd.Flags().StringVar(&healthAddr, "health-addr", "", "address of the /healthz and /readyz probes endpoint, e.g. :9801, disabled when empty")
+	runCmd.Flags().StringVar(&adminAddr, "admin-addr", "", "address of the local admin endpoint resizing the fuse and tun slots, e.g. 127.0.0.1:9091, disabled when empty")
 }
 
 var runCmd = &cobra.Command{
-	Use: "run [--fuse_mounts_allowed | --device ]",
+	Use: "run [--fuse_mounts_allowed | --device fuse,block | --config FILE]",
 	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadConfig()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		kubeletPaths = resolvePaths()
+		if !cmd.Flags().Changed("pod-resources-socket") {
+			podResources = kubeletPaths.PodResourcesSocket
+		}
+		log.Printf("Using device plugin directory %s, kubelet socket %s and pod resources socket %q", kubeletPaths.PluginDir, kubeletPaths.KubeletSocket, podResources)
+		managed := newManagedPlugins(cfg)
+
+		tracker := plugins.NewPodResourcesTracker(podResources, plugins.DefaultPodResourcesInterval)
+		tracker.SetResources(cfg.ResourceNames())
+		if podResources != "" {
+			stopTracker := make(chan struct{})
+			defer close(stopTracker)
+			go tracker.Run(stopTracker)
+		}
+
 		log.Println("Starting")
 		defer func() { log.Println("Stopped:") }()
 
 		log.Println("Starting FS watcher.")
-		watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+		watched := []string{kubeletPaths.PluginDir}
+		if filepath.Dir(kubeletPaths.KubeletSocket) != filepath.Clean(kubeletPaths.PluginDir) {
+			watched = append(watched, filepath.Dir(kubeletPaths.KubeletSocket))
+		}
+		if configFile != "" {
+			// watch the directory, ConfigMap updates replace the file through a symlink swap
+			watched = append(watched, filepath.Dir(configFile))
+		}
+		watcher, err := newFSWatcher(watched...)
 		if err != nil {
 			log.Println("Failed to created FS watcher.")
 			os.Exit(1)
@@ -61,50 +119,107 @@ var runCmd = &cobra.Command{
 		log.Println("Starting OS watcher.")
 		sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-		restart := true
-		var devicePlugin plugins.DevicePlugin
+		if metricsAddr != "" {
+			allocations := tracker
+			if podResources == "" {
+				// the allocations are unknown rather than empty
+				allocations = nil
+			}
+			go serveMetrics(metricsAddr, allocations)
+		}
+
+		status := &runStatus{}
+		if healthAddr != "" {
+			go serveHealth(healthAddr, status)
+		}
+		// the heartbeat also paces the watchdog
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		dog := newWatchdog(kubeletPaths.KubeletSocket)
+
+		resizes := make(chan resizeRequest)
+		if adminAddr != "" {
+			go serveAdmin(adminAddr, resizes, tracker)
+		}
 
 	L:
 		for {
-			if restart {
-				if devicePlugin != nil {
-					devicePlugin.Stop()
-				}
-
-				if device == "fuse" {
-					devicePlugin = plugins.NewFuseDevicePlugin(mountsAllowed)
-				} else {
-					devicePlugin, err = plugins.NewBlockDevicePlugin()
-					if err != nil {
-						log.Fatalln(err)
+			now := time.Now()
+			for _, p := range managed {
+				if p.restart && p.retry.due(now) {
+					p.serve()
+					if tracker.Listed() {
+						p.updateAllocations(tracker.Allocations())
 					}
 				}
+			}
+			status.update(managed)
 
-				if err := devicePlugin.Serve(); err != nil {
-					log.Println("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
-				} else {
-					restart = false
-				}
+			var retry <-chan time.Time
+			if d, ok := nextRetry(managed, time.Now()); ok {
+				retry = time.After(d)
 			}
 
 			select {
 			case event := <-watcher.Events:
-				if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-					log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
-					restart = true
+				kubelet := event.Name == filepath.Clean(kubeletPaths.KubeletSocket)
+				removed := event.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+				switch {
+				case kubelet && event.Op&fsnotify.Create == fsnotify.Create:
+					log.Printf("inotify: %s created, restarting.", kubeletPaths.KubeletSocket)
+					plugins.CountKubeletRestart()
+					dog.kubeletChanged()
+					restartAll(managed)
+				case kubelet && removed:
+					log.Printf("inotify: %s removed, waiting for kubelet.", kubeletPaths.KubeletSocket)
+				case filepath.Dir(event.Name) == filepath.Clean(kubeletPaths.PluginDir) && removed:
+					checkSockets(managed)
+				}
+				if configFile != "" && filepath.Dir(event.Name) == filepath.Dir(configFile) {
+					managed = reloadConfig(managed, tracker)
 				}
 
 			case err := <-watcher.Errors:
 				log.Printf("inotify: %s", err)
+				if errors.Is(err, fsnotify.ErrEventOverflow) {
+					// events were lost, look at the sockets themselves
+					dog.check(managed)
+				}
+
+			case <-tracker.Updates():
+				allocations := tracker.Allocations()
+				for _, p := range managed {
+					p.updateAllocations(allocations)
+				}
+
+			case <-heartbeat.C:
+				dog.check(managed)
+
+			case <-retry:
+
+			case req := <-resizes:
+				req.err <- resizeDevice(managed, req)
 
 			case s := <-sigs:
 				switch s {
 				case syscall.SIGHUP:
 					log.Println("Received SIGHUP, restarting.")
-					restart = true
+					if configFile != "" {
+						managed = reloadConfig(managed, tracker)
+					}
+					restartAll(managed)
 				default:
 					log.Printf("Received signal \"%v\", shutting down.", s)
-					devicePlugin.Stop()
+					if s == syscall.SIGTERM {
+						// kubelet stops handing out the devices of the node while it is rolled out
+						for _, p := range managed {
+							p.drain()
+						}
+						time.Sleep(drainDelay)
+					}
+					for _, p := range managed {
+						p.stop()
+					}
 					break L
 				}
 			}
@@ -112,6 +227,68 @@ var runCmd = &cobra.Command{
 	},
 }
 
+// serveMetrics serves the Prometheus metrics on addr until the process exits.
+func serveMetrics(addr string, tracker *plugins.PodResourcesTracker) {
+	log.Printf("Starting metrics endpoint on %s", addr)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", plugins.MetricsHandler(tracker))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("metrics endpoint: %s", err)
+	}
+}
+
+// serveHealth serves the probes on addr until the process exits.
+func serveHealth(addr string, status *runStatus) {
+	log.Printf("Starting health endpoint on %s", addr)
+	if err := http.ListenAndServe(addr, newHealthHandler(status)); err != nil {
+		log.Printf("health endpoint: %s", err)
+	}
+}
+
+// resolvePaths returns the sockets shared with kubelet from the flags, falling
+// back to the ones of the kubelet found in /proc, then to the defaults.
+func resolvePaths() plugins.Paths {
+	paths := plugins.DefaultPaths()
+	if pluginDir != "" {
+		if filepath.Base(filepath.Clean(pluginDir)) == "device-plugins" {
+			paths = plugins.KubeletPaths(filepath.Dir(filepath.Clean(pluginDir)))
+		}
+		paths.PluginDir = pluginDir
+		paths.KubeletSocket = filepath.Join(pluginDir, "kubelet.sock")
+	} else if rootDir, ok := plugins.DetectKubeletRootDir(procRoot); ok {
+		detected := plugins.KubeletPaths(rootDir)
+		// the host directory must be mounted at the same path in the pod
+		if _, err := os.Stat(detected.PluginDir); err == nil {
+			log.Printf("Detected kubelet root directory %s", rootDir)
+			paths = detected
+		} else {
+			log.Printf("Detected kubelet root directory %s, but cannot use it, keeping the default: %s", rootDir, err)
+		}
+	}
+	if kubeletSocket != "" {
+		paths.KubeletSocket = kubeletSocket
+	}
+	return paths
+}
+
+func loadConfig() (*config.Config, error) {
+	if configFile != "" {
+		return config.Load(configFile)
+	}
+	return config.FromFlags(devices, mountsAllowed, resourceDomain)
+}
+
+// reloadConfig re-reads the config file, keeping the running plugins if it is invalid.
+func reloadConfig(managed []*managedPlugin, tracker *plugins.PodResourcesTracker) []*managedPlugin {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		log.Printf("config: could not reload %s, keeping the current devices: %s", configFile, err)
+		return managed
+	}
+	tracker.SetResources(cfg.ResourceNames())
+	return reconcile(managed, cfg)
+}
+
 func main() {
 	cobra.CheckErr(rootCmd.Execute())
 }
@@ -0,0 +1,276 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/zwwhdls/node-device-plugin/config"
+	"github.com/zwwhdls/node-device-plugin/plugins"
+)
+
+// managedPlugin tracks one device plugin served by the run loop. Every plugin
+// has its own socket and registration, so it is restarted independently.
+type managedPlugin struct {
+	device  config.Device
+	plugin  plugins.DevicePlugin
+	restart bool
+	// err is the last failure to serve the plugin
+	err   error
+	retry backoff
+	// override is the number of slots set through the admin endpoint
+	override *slotsOverride
+}
+
+// slotsOverride is a number of slots set through the admin endpoint. It is
+// kept across config reloads until the config changes the slots of the device.
+type slotsOverride struct {
+	// config is the number of slots of the config when it was set
+	config int
+	slots  int
+}
+
+func newManagedPlugins(cfg *config.Config) []*managedPlugin {
+	var managed []*managedPlugin
+	for _, d := range cfg.Devices {
+		managed = append(managed, &managedPlugin{device: d, restart: true})
+	}
+	return managed
+}
+
+// reconcile applies a reloaded config: plugins that disappeared are stopped,
+// new or changed ones are marked for restart and unchanged ones are kept as is.
+func reconcile(managed []*managedPlugin, cfg *config.Config) []*managedPlugin {
+	current := map[string]*managedPlugin{}
+	for _, p := range managed {
+		current[p.device.Name] = p
+	}
+
+	var result []*managedPlugin
+	for _, d := range cfg.Devices {
+		p, ok := current[d.Name]
+		delete(current, d.Name)
+		if ok {
+			d = p.applyOverride(d)
+		}
+		switch {
+		case !ok:
+			log.Printf("config: device %s added", d.Name)
+			p = &managedPlugin{device: d, restart: true}
+		case reflect.DeepEqual(p.device, d):
+		case p.resize(d):
+		default:
+			log.Printf("config: device %s changed, restarting", d.Name)
+			p.stop()
+			p.device = d
+			p.restart = true
+			p.retry.reset()
+		}
+		result = append(result, p)
+	}
+
+	for name, p := range current {
+		log.Printf("config: device %s removed", name)
+		p.stop()
+	}
+	return result
+}
+
+// applyOverride returns d with the slots set through the admin endpoint, unless
+// the config changed them since, which drops the override.
+func (p *managedPlugin) applyOverride(d config.Device) config.Device {
+	if p.override == nil {
+		return d
+	}
+	slots, _ := deviceSlots(d)
+	if slots != p.override.config {
+		log.Printf("config: slots of device %s changed to %d, dropping the %d slots set through the admin endpoint", d.Name, slots, p.override.slots)
+		p.override = nil
+		return d
+	}
+	resized, ok := withSlots(d, p.override.slots)
+	if !ok {
+		p.override = nil
+		return d
+	}
+	return resized
+}
+
+// setOverride resizes the device to the slots requested through the admin
+// endpoint and keeps them across config reloads.
+func (p *managedPlugin) setOverride(slots int) error {
+	configSlots, _ := deviceSlots(p.device)
+	if p.override != nil {
+		configSlots = p.override.config
+	}
+	if err := p.resizeSlots(slots); err != nil {
+		return err
+	}
+	p.override = &slotsOverride{config: configSlots, slots: slots}
+	if slots == configSlots {
+		p.override = nil
+	}
+	return nil
+}
+
+// serve (re)creates the plugin and registers it with kubelet. On failure the
+// plugin stays marked for restart and is retried with a backoff.
+func (p *managedPlugin) serve() {
+	p.stop()
+
+	plugin, err := p.device.NewPlugin()
+	if err != nil {
+		d := p.retry.fail(time.Now())
+		log.Printf("Could not create %s device plugin, retrying in %s (attempt %d): %s", p.device.Name, d.Round(time.Millisecond), p.retry.failures, err)
+		p.err = err
+		return
+	}
+	plugin.SetPaths(kubeletPaths)
+	p.plugin = plugin
+
+	if err := p.plugin.Serve(); err != nil {
+		d := p.retry.fail(time.Now())
+		log.Printf("Could not contact Kubelet for %s device plugin, retrying in %s (attempt %d). Did you enable the device plugin feature gate?", p.device.Name, d.Round(time.Millisecond), p.retry.failures)
+		p.err = err
+		return
+	}
+	if p.retry.failures > 0 {
+		log.Printf("Served %s device plugin after %d failed attempts", p.device.Name, p.retry.failures)
+	}
+	p.restart = false
+	p.err = nil
+	p.retry.reset()
+}
+
+// nextRetry returns the delay until the next plugin waiting for a restart can
+// be retried, false if none is waiting.
+func nextRetry(managed []*managedPlugin, now time.Time) (time.Duration, bool) {
+	var next time.Time
+	waiting := false
+	for _, p := range managed {
+		if p.restart && (!waiting || p.retry.next.Before(next)) {
+			next, waiting = p.retry.next, true
+		}
+	}
+	return next.Sub(now), waiting
+}
+
+func (p *managedPlugin) stop() {
+	if p.plugin == nil {
+		return
+	}
+	if err := p.plugin.Stop(); err != nil {
+		log.Printf("Could not stop %s device plugin: %s", p.device.Name, err)
+	}
+	p.plugin = nil
+}
+
+// drain reports the devices of the plugin unhealthy to kubelet before it stops.
+func (p *managedPlugin) drain() {
+	if d, ok := p.plugin.(plugins.Drainer); ok {
+		d.Drain()
+	}
+}
+
+// resize applies d without restarting when only its number of slots changed,
+// it returns false when the plugin must be restarted instead. A refused
+// resize, e.g. a shrink while the allocations are unknown, keeps the current
+// slots rather than restarting the plugin with fewer.
+func (p *managedPlugin) resize(d config.Device) bool {
+	slots, ok := deviceSlots(d)
+	if !ok {
+		return false
+	}
+	resized, ok := withSlots(p.device, slots)
+	if !ok || !reflect.DeepEqual(resized, d) {
+		return false
+	}
+	if err := p.resizeSlots(slots); err != nil {
+		log.Printf("config: device %s not resized to %d slots: %s", d.Name, slots, err)
+		return true
+	}
+	log.Printf("config: device %s resized to %d slots", d.Name, slots)
+	return true
+}
+
+// resizeSlots changes the number of slots of the running fuse or tun plugin. A
+// plugin waiting for a restart picks the new number up when it is created.
+func (p *managedPlugin) resizeSlots(slots int) error {
+	resized, ok := withSlots(p.device, slots)
+	if !ok {
+		return fmt.Errorf("device %s has no slots", p.device.Name)
+	}
+	if slots <= 0 {
+		return fmt.Errorf("slots must be positive, got %d", slots)
+	}
+	if p.plugin != nil {
+		r, ok := p.plugin.(plugins.Resizer)
+		if !ok {
+			return fmt.Errorf("device %s cannot be resized", p.device.Name)
+		}
+		if err := r.Resize(slots); err != nil {
+			return err
+		}
+	}
+	p.device = resized
+	return nil
+}
+
+// deviceSlots returns the number of slots of d, false if it has none.
+func deviceSlots(d config.Device) (int, bool) {
+	switch {
+	case d.Fuse != nil:
+		return d.Fuse.Slots, true
+	case d.Tun != nil:
+		return d.Tun.Slots, true
+	}
+	return 0, false
+}
+
+// withSlots returns a copy of d with the given number of slots, false if it has none.
+func withSlots(d config.Device, slots int) (config.Device, bool) {
+	switch {
+	case d.Fuse != nil:
+		fuse := *d.Fuse
+		fuse.Slots = slots
+		d.Fuse = &fuse
+	case d.Tun != nil:
+		tun := *d.Tun
+		tun.Slots = slots
+		d.Tun = &tun
+	default:
+		return d, false
+	}
+	return d, true
+}
+
+// updateAllocations hands the allocated devices to the plugin if it follows them.
+func (p *managedPlugin) updateAllocations(allocations plugins.Allocations) {
+	if o, ok := p.plugin.(plugins.AllocationObserver); ok {
+		o.UpdateAllocations(allocations)
+	}
+}
+
+func restartAll(managed []*managedPlugin) {
+	for _, p := range managed {
+		p.restart = true
+		p.retry.reset()
+	}
+}
@@ -0,0 +1,168 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/zwwhdls/node-device-plugin/config"
+	"github.com/zwwhdls/node-device-plugin/plugins"
+)
+
+func mustParse(t *testing.T, data string) *config.Config {
+	cfg, err := config.Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// fakePlugin records the calls of the run loop.
+type fakePlugin struct {
+	stopped bool
+	slots   int
+	// socketErr is returned by CheckSocket
+	socketErr error
+}
+
+func (p *fakePlugin) Serve() error { return nil }
+
+func (p *fakePlugin) Stop() error {
+	p.stopped = true
+	return nil
+}
+
+func (p *fakePlugin) SetPaths(plugins.Paths) {}
+
+func (p *fakePlugin) Resize(slots int) error {
+	p.slots = slots
+	return nil
+}
+
+func (p *fakePlugin) CheckSocket() error { return p.socketErr }
+
+func TestReconcile(t *testing.T) {
+	base := "devices: [{name: fuse, fuse: {slots: 10}}, {name: tun, tun: {}}]"
+	tests := []struct {
+		name   string
+		config string
+		// want are the devices kept, with whether they restart
+		want    map[string]bool
+		stopped []string
+		slots   int
+	}{
+		{
+			name:   "unchanged",
+			config: base,
+			want:   map[string]bool{"fuse": false, "tun": false},
+		},
+		{
+			name:   "slots only",
+			config: "devices: [{name: fuse, fuse: {slots: 20}}, {name: tun, tun: {}}]",
+			want:   map[string]bool{"fuse": false, "tun": false},
+			slots:  20,
+		},
+		{
+			name:    "resource changed",
+			config:  "devices: [{name: fuse, fuse: {slots: 10, resourceName: fast-fuse}}, {name: tun, tun: {}}]",
+			want:    map[string]bool{"fuse": true, "tun": false},
+			stopped: []string{"fuse"},
+		},
+		{
+			name:    "removed",
+			config:  "devices: [{name: tun, tun: {}}]",
+			want:    map[string]bool{"tun": false},
+			stopped: []string{"fuse"},
+		},
+	}
+
+	Convey("Test reconcile a reloaded config", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				managed := newManagedPlugins(mustParse(t, base))
+				fakes := map[string]*fakePlugin{}
+				for _, p := range managed {
+					fakes[p.device.Name] = &fakePlugin{}
+					p.plugin = fakes[p.device.Name]
+					p.restart = false
+				}
+				cfg := mustParse(t, tt.config)
+
+				managed = reconcile(managed, cfg)
+				restarts := map[string]bool{}
+				for _, p := range managed {
+					restarts[p.device.Name] = p.restart
+				}
+				So(restarts, ShouldResemble, tt.want)
+				for name, f := range fakes {
+					So(f.stopped, ShouldEqual, contains(tt.stopped, name))
+				}
+				So(fakes["fuse"].slots, ShouldEqual, tt.slots)
+				for i, p := range managed {
+					So(p.device, ShouldResemble, cfg.Devices[i])
+				}
+			})
+		}
+	})
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReconcile_adminOverride(t *testing.T) {
+	Convey("Test admin slots kept across reloads", t, func() {
+		cfg := mustParse(t, "devices: [{name: fuse, fuse: {slots: 10}}]")
+		managed := reconcile(nil, cfg)
+		managed[0].restart = false
+		So(resizeDevice(managed, resizeRequest{device: "fuse", slots: 20}), ShouldBeNil)
+		So(managed[0].device.Fuse.Slots, ShouldEqual, 20)
+
+		Convey("unchanged config", func() {
+			managed = reconcile(managed, cfg)
+			So(managed[0].device.Fuse.Slots, ShouldEqual, 20)
+			So(managed[0].restart, ShouldBeFalse)
+		})
+
+		Convey("other fields changed", func() {
+			managed = reconcile(managed, mustParse(t, "devices: [{name: fuse, fuse: {slots: 10, resourceName: fast-fuse}}]"))
+			So(managed[0].device.Fuse.Slots, ShouldEqual, 20)
+			So(managed[0].device.Fuse.ResourceName, ShouldEqual, "hdls.me/fast-fuse")
+			So(managed[0].restart, ShouldBeTrue)
+		})
+
+		Convey("slots changed by the config", func() {
+			managed = reconcile(managed, mustParse(t, "devices: [{name: fuse, fuse: {slots: 30}}]"))
+			So(managed[0].device.Fuse.Slots, ShouldEqual, 30)
+			So(managed[0].override, ShouldBeNil)
+			managed = reconcile(managed, mustParse(t, "devices: [{name: fuse, fuse: {slots: 10}}]"))
+			So(managed[0].device.Fuse.Slots, ShouldEqual, 10)
+		})
+
+		Convey("back to the config slots", func() {
+			So(resizeDevice(managed, resizeRequest{device: "fuse", slots: 10}), ShouldBeNil)
+			So(managed[0].override, ShouldBeNil)
+		})
+	})
+}
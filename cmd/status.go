@@ -0,0 +1,112 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is the period of the run loop heartbeat, the loop is
+// considered stuck after livenessTimeout without one.
+const (
+	heartbeatInterval = 10 * time.Second
+	livenessTimeout   = 3 * heartbeatInterval
+)
+
+// pluginStatus is the state of a managed plugin seen by the probes.
+type pluginStatus struct {
+	Device string `json:"device"`
+	// Ready is set when the gRPC server is serving and registered with kubelet.
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+	// Failures is the number of failed attempts since the plugin last served,
+	// and NextRetry the time of the next one.
+	Failures  int        `json:"failures,omitempty"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+}
+
+// runStatus is the state of the run loop, published for the probes.
+type runStatus struct {
+	mu        sync.RWMutex
+	heartbeat time.Time
+	plugins   []pluginStatus
+}
+
+// update records a heartbeat and the state of the managed plugins, it is
+// called by the run loop on every iteration.
+func (s *runStatus) update(managed []*managedPlugin) {
+	plugins := make([]pluginStatus, 0, len(managed))
+	for _, p := range managed {
+		ps := pluginStatus{Device: p.device.Name, Ready: !p.restart && p.plugin != nil}
+		if p.err != nil {
+			ps.Error = p.err.Error()
+		}
+		if p.restart && p.retry.failures > 0 {
+			next := p.retry.next
+			ps.Failures, ps.NextRetry = p.retry.failures, &next
+		}
+		plugins = append(plugins, ps)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeat = time.Now()
+	s.plugins = plugins
+}
+
+func (s *runStatus) alive() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.heartbeat) < livenessTimeout
+}
+
+func (s *runStatus) ready() ([]pluginStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ready := !s.heartbeat.IsZero()
+	for _, p := range s.plugins {
+		ready = ready && p.Ready
+	}
+	return s.plugins, ready
+}
+
+// newHealthHandler serves the probes:
+//
+//	GET /healthz  the run loop is alive
+//	GET /readyz   every plugin is serving and registered with kubelet
+func newHealthHandler(status *runStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !status.alive() {
+			http.Error(w, "run loop is stuck", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		plugins, ready := status.ready()
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(plugins)
+	})
+	return mux
+}
@@ -0,0 +1,94 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealthHandler(t *testing.T) {
+	Convey("Test health probes", t, func() {
+		status := &runStatus{}
+		handler := newHealthHandler(status)
+		get := func(path string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			return w
+		}
+		readyz := func() (int, []pluginStatus) {
+			w := get("/readyz")
+			var plugins []pluginStatus
+			So(json.Unmarshal(w.Body.Bytes(), &plugins), ShouldBeNil)
+			return w.Code, plugins
+		}
+		managed := newManagedPlugins(mustParse(t, "devices: [{name: fuse, fuse: {}}, {name: tun, tun: {}}]"))
+		for _, p := range managed {
+			p.plugin = &fakePlugin{}
+			p.restart = false
+		}
+
+		Convey("before the first iteration", func() {
+			So(get("/healthz").Code, ShouldEqual, http.StatusServiceUnavailable)
+			code, _ := readyz()
+			So(code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("all plugins ready", func() {
+			status.update(managed)
+			So(get("/healthz").Code, ShouldEqual, http.StatusOK)
+			code, plugins := readyz()
+			So(code, ShouldEqual, http.StatusOK)
+			So(plugins, ShouldResemble, []pluginStatus{{Device: "fuse", Ready: true}, {Device: "tun", Ready: true}})
+			_, ready := status.ready()
+			So(ready, ShouldBeTrue)
+		})
+
+		Convey("a plugin pending restart", func() {
+			managed[1].restart = true
+			managed[1].err = errors.New("kubelet is not running")
+			managed[1].retry.fail(time.Now())
+			status.update(managed)
+
+			So(get("/healthz").Code, ShouldEqual, http.StatusOK)
+			code, plugins := readyz()
+			So(code, ShouldEqual, http.StatusServiceUnavailable)
+			So(plugins[0].Ready, ShouldBeTrue)
+			So(plugins[1].Ready, ShouldBeFalse)
+			So(plugins[1].Error, ShouldEqual, "kubelet is not running")
+			So(plugins[1].Failures, ShouldEqual, 1)
+			So(plugins[1].NextRetry.Equal(managed[1].retry.next), ShouldBeTrue)
+			_, ready := status.ready()
+			So(ready, ShouldBeFalse)
+		})
+
+		Convey("a stale heartbeat", func() {
+			status.update(managed)
+			status.heartbeat = time.Now().Add(-livenessTimeout)
+			So(get("/healthz").Code, ShouldEqual, http.StatusServiceUnavailable)
+			// the plugins themselves may still be serving
+			code, _ := readyz()
+			So(code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
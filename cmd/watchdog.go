@@ -0,0 +1,81 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/zwwhdls/node-device-plugin/plugins"
+)
+
+// watchdog notices from the file system what fsnotify events may miss: a
+// kubelet socket replaced while events overflowed, or the socket of a plugin
+// removed or replaced, which kubelet does when it restarts.
+type watchdog struct {
+	kubeletSocket string
+	kubelet       os.FileInfo
+}
+
+func newWatchdog(kubeletSocket string) *watchdog {
+	w := &watchdog{kubeletSocket: kubeletSocket}
+	w.kubeletChanged()
+	return w
+}
+
+// kubeletChanged tells whether the kubelet socket is another file than the
+// last time it was seen, meaning kubelet restarted.
+func (w *watchdog) kubeletChanged() bool {
+	fi, err := os.Stat(w.kubeletSocket)
+	if err != nil {
+		// kubelet is down, its new socket will tell when it is back
+		return false
+	}
+	changed := w.kubelet != nil && !os.SameFile(fi, w.kubelet)
+	w.kubelet = fi
+	return changed
+}
+
+// check restarts every plugin when kubelet restarted, otherwise the ones
+// whose socket is gone.
+func (w *watchdog) check(managed []*managedPlugin) {
+	if w.kubeletChanged() {
+		log.Printf("watchdog: %s was replaced, restarting.", w.kubeletSocket)
+		plugins.CountKubeletRestart()
+		restartAll(managed)
+		return
+	}
+	checkSockets(managed)
+}
+
+// checkSockets restarts the plugins whose socket was removed or replaced.
+func checkSockets(managed []*managedPlugin) {
+	for _, p := range managed {
+		if p.restart || p.plugin == nil {
+			continue
+		}
+		c, ok := p.plugin.(plugins.SocketChecker)
+		if !ok {
+			continue
+		}
+		if err := c.CheckSocket(); err != nil {
+			log.Printf("watchdog: socket of %s device plugin lost, re-registering: %s", p.device.Name, err)
+			p.restart = true
+			p.retry.reset()
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWatchdog(t *testing.T) {
+	Convey("Test watchdog on a replaced kubelet socket", t, func() {
+		socket := filepath.Join(t.TempDir(), "kubelet.sock")
+		So(os.WriteFile(socket, nil, 0600), ShouldBeNil)
+		managed := newManagedPlugins(mustParse(t, "devices: [{name: fuse, fuse: {}}, {name: tun, tun: {}}]"))
+		for _, p := range managed {
+			p.plugin = &fakePlugin{}
+			p.restart = false
+		}
+		dog := newWatchdog(socket)
+		restarts := func() []bool {
+			var restarts []bool
+			for _, p := range managed {
+				restarts = append(restarts, p.restart)
+			}
+			return restarts
+		}
+
+		Convey("unchanged", func() {
+			dog.check(managed)
+			So(restarts(), ShouldResemble, []bool{false, false})
+		})
+
+		Convey("kubelet down", func() {
+			So(os.Remove(socket), ShouldBeNil)
+			dog.check(managed)
+			So(restarts(), ShouldResemble, []bool{false, false})
+		})
+
+		Convey("replaced", func() {
+			// kubelet creates a new socket file when it restarts
+			replacement := socket + ".new"
+			So(os.WriteFile(replacement, nil, 0600), ShouldBeNil)
+			So(os.Rename(replacement, socket), ShouldBeNil)
+			managed[1].retry.fail(time.Now())
+			dog.check(managed)
+			So(restarts(), ShouldResemble, []bool{true, true})
+			So(managed[1].retry.failures, ShouldEqual, 0)
+
+			for _, p := range managed {
+				p.restart = false
+			}
+			dog.check(managed)
+			So(restarts(), ShouldResemble, []bool{false, false})
+		})
+	})
+}
+
+func TestCheckSockets(t *testing.T) {
+	Convey("Test restart the plugins whose socket is lost", t, func() {
+		managed := newManagedPlugins(mustParse(t, "devices: [{name: fuse, fuse: {}}, {name: tun, tun: {}}, {name: kvm, generic: {resourceName: hdls.me/kvm, devices: [{hostPath: /dev/kvm}], slots: 2}}]"))
+		for _, p := range managed {
+			p.plugin = &fakePlugin{}
+			p.restart = false
+		}
+		managed[0].plugin.(*fakePlugin).socketErr = errors.New("socket removed")
+		// already waiting for a retry
+		managed[2].restart = true
+		managed[2].retry.fail(time.Now())
+		managed[2].plugin.(*fakePlugin).socketErr = errors.New("socket removed")
+
+		checkSockets(managed)
+		So(managed[0].restart, ShouldBeTrue)
+		So(managed[1].restart, ShouldBeFalse)
+		So(managed[2].retry.failures, ShouldEqual, 1)
+	})
+}
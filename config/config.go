@@ -0,0 +1,238 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/zwwhdls/node-device-plugin/plugins"
+)
+
+// Config is the content of the file given to `run --config`, in YAML or JSON.
+type Config struct {
+	// ResourceDomain is the default domain of the devices' resource names.
+	ResourceDomain string   `json:"resourceDomain,omitempty"`
+	Devices        []Device `json:"devices"`
+}
+
+// Device configures one device plugin. Exactly one of Fuse, Tun, Block and
+// Generic must be set.
+type Device struct {
+	// Name identifies the plugin across reloads.
+	Name    string               `json:"name"`
+	Fuse    *plugins.FuseSpec    `json:"fuse,omitempty"`
+	Tun     *plugins.TunSpec     `json:"tun,omitempty"`
+	Block   *plugins.BlockSpec   `json:"block,omitempty"`
+	Generic *plugins.GenericSpec `json:"generic,omitempty"`
+}
+
+// Load reads and validates the config file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates a YAML or JSON config.
+func Parse(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("parse config: %s", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FromFlags builds the config equivalent to the `--device`,
+// `--fuse_mounts_allowed` and `--resource-domain` flags.
+func FromFlags(devices []string, fuseSlots int, resourceDomain string) (*Config, error) {
+	c := &Config{ResourceDomain: resourceDomain}
+	for _, name := range devices {
+		name = strings.TrimSpace(name)
+		d := Device{Name: name}
+		switch name {
+		case "fuse":
+			d.Fuse = &plugins.FuseSpec{SlotSpec: plugins.SlotSpec{Slots: fuseSlots}}
+		case "tun":
+			d.Tun = &plugins.TunSpec{}
+		case "block":
+			d.Block = &plugins.BlockSpec{}
+		default:
+			return nil, fmt.Errorf("unknown device %q, supported devices: fuse,tun,block", name)
+		}
+		c.Devices = append(c.Devices, d)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks every device and fills in the defaults.
+func (c *Config) Validate() error {
+	if len(c.Devices) == 0 {
+		return fmt.Errorf("no device configured")
+	}
+	if c.ResourceDomain == "" {
+		c.ResourceDomain = plugins.DefaultResourceDomain
+	}
+	names := map[string]bool{}
+	resources := map[string]string{}
+	sockets := map[string]string{}
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		if d.Name != "" {
+			d.setDefaults(c.ResourceDomain)
+		}
+		if err := d.Validate(); err != nil {
+			return err
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicated device %q", d.Name)
+		}
+		names[d.Name] = true
+
+		for _, e := range d.endpoints() {
+			resource, socket := e[0], e[1]
+			if other, ok := resources[resource]; ok {
+				return fmt.Errorf("devices %s and %s advertise the same resource %s", other, d.Name, resource)
+			}
+			resources[resource] = d.Name
+			if other, ok := sockets[socket]; ok {
+				return fmt.Errorf("devices %s and %s use the same socket %s", other, d.Name, socket)
+			}
+			sockets[socket] = d.Name
+		}
+	}
+	return nil
+}
+
+// ResourceNames returns the resource names advertised by the devices of a validated config.
+func (c *Config) ResourceNames() []string {
+	var names []string
+	for i := range c.Devices {
+		for _, e := range c.Devices[i].endpoints() {
+			names = append(names, e[0])
+		}
+	}
+	return names
+}
+
+// setDefaults applies the config wide resource domain and names the socket
+// after the device, so that several instances of a plugin can coexist.
+func (d *Device) setDefaults(resourceDomain string) {
+	var resource *plugins.Resource
+	var socket *string
+	switch {
+	case d.Fuse != nil:
+		resource, socket = &d.Fuse.Resource, &d.Fuse.SocketName
+	case d.Tun != nil:
+		resource, socket = &d.Tun.Resource, &d.Tun.SocketName
+	case d.Block != nil:
+		resource, socket = &d.Block.Resource, &d.Block.SocketName
+	case d.Generic != nil:
+		resource, socket = &d.Generic.Resource, &d.Generic.SocketName
+	default:
+		return
+	}
+	if resource.ResourceDomain == "" {
+		resource.ResourceDomain = resourceDomain
+	}
+	if *socket == "" {
+		*socket = d.Name + ".sock"
+	}
+}
+
+// endpoints returns the resource names and sockets of a validated device.
+func (d *Device) endpoints() [][2]string {
+	switch {
+	case d.Fuse != nil:
+		return [][2]string{{d.Fuse.ResourceName, d.Fuse.SocketName}}
+	case d.Tun != nil:
+		return [][2]string{{d.Tun.ResourceName, d.Tun.SocketName}}
+	case d.Block != nil:
+		var endpoints [][2]string
+		for _, c := range d.Block.EffectiveClasses() {
+			endpoints = append(endpoints, [2]string{c.ResourceName, c.SocketName})
+		}
+		return endpoints
+	default:
+		return [][2]string{{d.Generic.ResourceName, d.Generic.SocketName}}
+	}
+}
+
+// Validate checks the device and fills in the defaults of its spec.
+func (d *Device) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("device name is required")
+	}
+	set := 0
+	if d.Fuse != nil {
+		set++
+		if err := d.Fuse.Validate(); err != nil {
+			return fmt.Errorf("device %s: %s", d.Name, err)
+		}
+	}
+	if d.Tun != nil {
+		set++
+		if err := d.Tun.Validate(); err != nil {
+			return fmt.Errorf("device %s: %s", d.Name, err)
+		}
+	}
+	if d.Block != nil {
+		set++
+		if err := d.Block.Validate(); err != nil {
+			return fmt.Errorf("device %s: %s", d.Name, err)
+		}
+	}
+	if d.Generic != nil {
+		set++
+		if d.Generic.Name == "" {
+			d.Generic.Name = d.Name
+		}
+		if err := d.Generic.Validate(); err != nil {
+			return err
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("device %s: exactly one of fuse, tun, block or generic must be set", d.Name)
+	}
+	return nil
+}
+
+// NewPlugin creates the device plugin described by d.
+func (d Device) NewPlugin() (plugins.DevicePlugin, error) {
+	switch {
+	case d.Fuse != nil:
+		return plugins.NewFuseDevicePlugin(*d.Fuse)
+	case d.Tun != nil:
+		return plugins.NewTunDevicePlugin(*d.Tun)
+	case d.Block != nil:
+		return plugins.NewBlockDevicePlugin(*d.Block)
+	case d.Generic != nil:
+		return plugins.NewGenericDevicePlugin(*d.Generic)
+	}
+	return nil, fmt.Errorf("device %s: no plugin configured", d.Name)
+}
@@ -0,0 +1,139 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParse(t *testing.T) {
+	Convey("Test config parse", t, func() {
+		Convey("yaml", func() {
+			c, err := Load("../example/config.yaml")
+			So(err, ShouldBeNil)
+			So(c.Devices, ShouldHaveLength, 4)
+			So(c.Devices[0].Fuse.Slots, ShouldEqual, 5000)
+			So(c.Devices[1].Block.SocketName, ShouldEqual, "block.sock")
+			So(c.Devices[2].Generic.Name, ShouldEqual, "kvm")
+			So(c.Devices[2].Generic.Devices[0].ContainerPath, ShouldEqual, "/dev/kvm")
+			So(c.Devices[3].Tun.Slots, ShouldEqual, 100)
+			So(c.Devices[3].Tun.SocketName, ShouldEqual, "tun.sock")
+		})
+		Convey("json", func() {
+			c, err := Parse([]byte(`{"devices": [{"name": "fuse", "fuse": {"slots": 10}}]}`))
+			So(err, ShouldBeNil)
+			So(c.Devices[0].Fuse.ResourceName, ShouldEqual, "hdls.me/fuse")
+		})
+		Convey("invalid", func() {
+			_, err := Parse([]byte(`devices: [{name: fuse}]`))
+			So(err, ShouldNotBeNil)
+			_, err = Parse([]byte(`devices: [{name: fuse, fuse: {}}, {name: fuse, block: {}}]`))
+			So(err, ShouldNotBeNil)
+			_, err = Parse([]byte(`devices: [{name: fuse, fuse: {slot: 1}}]`))
+			So(err, ShouldNotBeNil)
+			_, err = Parse([]byte(`devices: [{name: tun, tun: {}, fuse: {}}]`))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("resource names", func() {
+			c, err := Parse([]byte(`
+resourceDomain: example.com
+devices:
+  - name: fast-fuse
+    fuse: {resourceName: fast-fuse, slots: 10}
+  - name: bulk-fuse
+    fuse: {resourceName: other.io/bulk-fuse, slots: 1000}
+`))
+			So(err, ShouldBeNil)
+			So(c.Devices[0].Fuse.ResourceName, ShouldEqual, "example.com/fast-fuse")
+			So(c.Devices[0].Fuse.SocketName, ShouldEqual, "fast-fuse.sock")
+			So(c.Devices[1].Fuse.ResourceName, ShouldEqual, "other.io/bulk-fuse")
+			So(c.Devices[1].Fuse.SocketName, ShouldEqual, "bulk-fuse.sock")
+
+			_, err = Parse([]byte(`devices: [{name: a, fuse: {}}, {name: b, fuse: {}}]`))
+			So(err, ShouldNotBeNil)
+			_, err = Parse([]byte(`devices: [{name: a, fuse: {resourceName: kubernetes.io/fuse}}]`))
+			So(err, ShouldNotBeNil)
+			_, err = Parse([]byte(`devices: [{name: a, fuse: {resourceDomain: Example.COM}}]`))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("block classes", func() {
+			c, err := Parse([]byte(`
+resourceDomain: example.com
+devices:
+  - name: disks
+    block:
+      classes:
+        - resourceName: nvme
+          selector: {names: ["nvme*"]}
+        - resourceName: hdd
+          selector: {rotational: true, minSize: 1Ti}
+  - name: ssd
+    block:
+      resourceName: ssd
+      selector: {rotational: false}
+`))
+			So(err, ShouldBeNil)
+			So(c.Devices[0].Block.Classes[1].ResourceName, ShouldEqual, "example.com/hdd")
+			So(c.Devices[0].Block.Classes[1].SocketName, ShouldEqual, "disks-hdd.sock")
+			So(c.ResourceNames(), ShouldResemble, []string{"example.com/nvme", "example.com/hdd", "example.com/ssd"})
+
+			_, err = Parse([]byte(`
+devices:
+  - name: disks
+    block: {classes: [{resourceName: nvme}]}
+  - name: nvme
+    block: {resourceName: nvme}
+`))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("allocation policies", func() {
+			c, err := Parse([]byte(`
+devices:
+  - name: disks
+    block:
+      allocationPolicy: same-controller
+      classes:
+        - resourceName: nvme
+          selector: {names: ["nvme*"]}
+          allocationPolicy: numa
+        - resourceName: hdd
+  - name: fuse
+    fuse: {allocationPolicy: pack}
+`))
+			So(err, ShouldBeNil)
+			So(c.Devices[0].Block.Classes[0].AllocationPolicy, ShouldEqual, "numa")
+			So(c.Devices[0].Block.Classes[1].AllocationPolicy, ShouldEqual, "same-controller")
+
+			_, err = Parse([]byte(`devices: [{name: fuse, fuse: {allocationPolicy: same-controller}}]`))
+			So(err, ShouldNotBeNil)
+			_, err = Parse([]byte(`devices: [{name: disks, block: {allocationPolicy: random}}]`))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("flags", func() {
+			c, err := FromFlags([]string{"fuse", "block", "tun"}, 10, "example.com")
+			So(err, ShouldBeNil)
+			So(c.Devices, ShouldHaveLength, 3)
+			So(c.Devices[0].Fuse.ResourceName, ShouldEqual, "example.com/fuse")
+			So(c.Devices[1].Block.ResourceName, ShouldEqual, "example.com/sdx")
+			So(c.Devices[2].Tun.ResourceName, ShouldEqual, "example.com/tun")
+			_, err = FromFlags([]string{"fuse", "gpu"}, 10, "")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
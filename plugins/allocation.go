@@ -0,0 +1,249 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"fmt"
+	"sort"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// The allocation policies decide which of the available devices kubelet
+// should prefer in GetPreferredAllocation.
+const (
+	// PackPolicy fills the controllers that are already the most used, keeping
+	// the others free for larger requests.
+	PackPolicy = "pack"
+	// SpreadPolicy spreads the devices over as many controllers as possible.
+	SpreadPolicy = "spread"
+	// SameControllerPolicy takes all the disks from a single controller (HBA)
+	// when possible. Block devices only.
+	SameControllerPolicy = "same-controller"
+	// NUMAPolicy takes all the devices from a single NUMA node when possible.
+	// Block devices only, the slots have no topology.
+	NUMAPolicy = "numa"
+)
+
+// validateAllocationPolicy checks that policy is known and, unless block is
+// set, that it does not need block devices.
+func validateAllocationPolicy(policy string, block bool) error {
+	switch policy {
+	case "", PackPolicy, SpreadPolicy:
+		return nil
+	case SameControllerPolicy, NUMAPolicy:
+		if block {
+			return nil
+		}
+		return fmt.Errorf("allocation policy %s only applies to block devices", policy)
+	}
+	return fmt.Errorf("unknown allocation policy %q, expected one of %s, %s, %s or %s",
+		policy, PackPolicy, SpreadPolicy, SameControllerPolicy, NUMAPolicy)
+}
+
+// allocatable is what the policies know about a device.
+type allocatable struct {
+	id string
+	// controller is the PCI address of the controller of a disk, empty if unknown.
+	controller string
+	// numa is the NUMA node of the device, empty if unknown.
+	numa string
+}
+
+// allocatableDevice returns the allocatable of a device without controller.
+func allocatableDevice(d *pluginapi.Device) allocatable {
+	a := allocatable{id: d.ID}
+	if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+		a.numa = fmt.Sprint(d.Topology.Nodes[0].ID)
+	}
+	return a
+}
+
+// preferredAllocation answers a GetPreferredAllocation request with policy,
+// devs being all the devices of the plugin in their advertised order.
+func preferredAllocation(policy string, devs []allocatable, reqs *pluginapi.PreferredAllocationRequest) *pluginapi.PreferredAllocationResponse {
+	resp := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		available := map[string]bool{}
+		for _, id := range req.AvailableDeviceIDs {
+			available[id] = true
+		}
+		var candidates []allocatable
+		for _, d := range devs {
+			if available[d.id] {
+				candidates = append(candidates, d)
+			}
+		}
+		resp.ContainerResponses = append(resp.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: preferDevices(policy, candidates, req.MustIncludeDeviceIDs, int(req.AllocationSize)),
+		})
+	}
+	return resp
+}
+
+// preferDevices returns size devices out of available, starting with mustInclude.
+func preferDevices(policy string, available []allocatable, mustInclude []string, size int) []string {
+	chosen := map[string]bool{}
+	var ids []string
+	for _, id := range mustInclude {
+		if !chosen[id] {
+			chosen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var must, rest []allocatable
+	for _, d := range available {
+		if chosen[d.id] {
+			must = append(must, d)
+		} else {
+			rest = append(rest, d)
+		}
+	}
+	need := size - len(ids)
+	if need <= 0 {
+		return ids
+	}
+	if need > len(rest) {
+		need = len(rest)
+	}
+
+	var picked []allocatable
+	switch policy {
+	case PackPolicy:
+		picked = pack(rest, must, need, controllerKey)
+	case SpreadPolicy:
+		picked = spread(rest, must, need, controllerKey)
+	case SameControllerPolicy:
+		picked = align(rest, must, need, controllerKey)
+	case NUMAPolicy:
+		picked = align(rest, must, need, numaKey)
+	default:
+		picked = rest[:need]
+	}
+	for _, d := range picked {
+		ids = append(ids, d.id)
+	}
+	return ids
+}
+
+func controllerKey(d allocatable) string { return d.controller }
+
+func numaKey(d allocatable) string { return d.numa }
+
+// deviceGroup is the available devices sharing a key, e.g. a controller.
+type deviceGroup struct {
+	key     string
+	devices []allocatable
+	// picked is the number of devices of the group in the allocation, at
+	// first the mandatory ones.
+	picked int
+}
+
+// groupDevices groups devices by key, in the order of their first device.
+func groupDevices(devices, must []allocatable, key func(allocatable) string) []*deviceGroup {
+	var groups []*deviceGroup
+	byKey := map[string]*deviceGroup{}
+	get := func(k string) *deviceGroup {
+		g, ok := byKey[k]
+		if !ok {
+			g = &deviceGroup{key: k}
+			byKey[k] = g
+			groups = append(groups, g)
+		}
+		return g
+	}
+	for _, d := range devices {
+		g := get(key(d))
+		g.devices = append(g.devices, d)
+	}
+	for _, d := range must {
+		get(key(d)).picked++
+	}
+	return groups
+}
+
+// take returns the first n devices of the groups, in order.
+func take(groups []*deviceGroup, n int) []allocatable {
+	var picked []allocatable
+	for _, g := range groups {
+		for _, d := range g.devices {
+			if len(picked) == n {
+				return picked
+			}
+			picked = append(picked, d)
+		}
+	}
+	return picked
+}
+
+// pack prefers the groups of the mandatory devices, then the groups with the
+// fewest available devices.
+func pack(devices, must []allocatable, n int, key func(allocatable) string) []allocatable {
+	groups := groupDevices(devices, must, key)
+	sort.SliceStable(groups, func(i, j int) bool {
+		if (groups[i].picked > 0) != (groups[j].picked > 0) {
+			return groups[i].picked > 0
+		}
+		return len(groups[i].devices) < len(groups[j].devices)
+	})
+	return take(groups, n)
+}
+
+// spread takes one device at a time from the group with the fewest devices
+// picked so far, the mandatory ones included.
+func spread(devices, must []allocatable, n int, key func(allocatable) string) []allocatable {
+	groups := groupDevices(devices, must, key)
+	var picked []allocatable
+	for len(picked) < n {
+		var best *deviceGroup
+		for _, g := range groups {
+			if len(g.devices) == 0 {
+				continue
+			}
+			if best == nil || g.picked < best.picked || g.picked == best.picked && len(g.devices) > len(best.devices) {
+				best = g
+			}
+		}
+		picked = append(picked, best.devices[0])
+		best.devices = best.devices[1:]
+		best.picked++
+	}
+	return picked
+}
+
+// align takes the devices from as few groups as possible: the groups of the
+// mandatory devices first, then the smallest group that fits the request, or
+// the largest groups when none does.
+func align(devices, must []allocatable, n int, key func(allocatable) string) []allocatable {
+	groups := groupDevices(devices, must, key)
+	sort.SliceStable(groups, func(i, j int) bool {
+		gi, gj := groups[i], groups[j]
+		if (gi.picked > 0) != (gj.picked > 0) {
+			return gi.picked > 0
+		}
+		fi, fj := len(gi.devices) >= n, len(gj.devices) >= n
+		if fi != fj {
+			return fi
+		}
+		if fi {
+			return len(gi.devices) < len(gj.devices)
+		}
+		return len(gi.devices) > len(gj.devices)
+	})
+	return take(groups, n)
+}
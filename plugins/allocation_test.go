@@ -0,0 +1,96 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func Test_preferDevices(t *testing.T) {
+	// hba0 has 3 free disks, hba1 has 1 and hba2 has 2, hba0 and hba1 are on NUMA node 0
+	disks := []allocatable{
+		{id: "sda", controller: "hba0", numa: "0"},
+		{id: "sdb", controller: "hba0", numa: "0"},
+		{id: "sdc", controller: "hba0", numa: "0"},
+		{id: "sdd", controller: "hba1", numa: "0"},
+		{id: "sde", controller: "hba2", numa: "1"},
+		{id: "sdf", controller: "hba2", numa: "1"},
+	}
+	slots := []allocatable{{id: "fuse-0"}, {id: "fuse-1"}, {id: "fuse-2"}}
+
+	tests := []struct {
+		name        string
+		policy      string
+		devices     []allocatable
+		mustInclude []string
+		size        int
+		want        []string
+	}{
+		{name: "no policy", policy: "", devices: disks, size: 2, want: []string{"sda", "sdb"}},
+		{name: "pack least free controller", policy: PackPolicy, devices: disks, size: 1, want: []string{"sdd"}},
+		{name: "pack overflows", policy: PackPolicy, devices: disks, size: 3, want: []string{"sdd", "sde", "sdf"}},
+		{name: "pack with mandatory", policy: PackPolicy, devices: disks, mustInclude: []string{"sda"}, size: 3, want: []string{"sda", "sdb", "sdc"}},
+		{name: "pack slots", policy: PackPolicy, devices: slots, size: 2, want: []string{"fuse-0", "fuse-1"}},
+		{name: "spread", policy: SpreadPolicy, devices: disks, size: 3, want: []string{"sda", "sde", "sdd"}},
+		{name: "spread with mandatory", policy: SpreadPolicy, devices: disks, mustInclude: []string{"sda"}, size: 3, want: []string{"sda", "sde", "sdd"}},
+		{name: "spread more than controllers", policy: SpreadPolicy, devices: disks, size: 5, want: []string{"sda", "sde", "sdd", "sdb", "sdf"}},
+		{name: "same controller best fit", policy: SameControllerPolicy, devices: disks, size: 2, want: []string{"sde", "sdf"}},
+		{name: "same controller largest", policy: SameControllerPolicy, devices: disks, size: 3, want: []string{"sda", "sdb", "sdc"}},
+		{name: "same controller too large", policy: SameControllerPolicy, devices: disks, size: 4, want: []string{"sda", "sdb", "sdc", "sde"}},
+		{name: "same controller mandatory", policy: SameControllerPolicy, devices: disks, mustInclude: []string{"sdf"}, size: 2, want: []string{"sdf", "sde"}},
+		{name: "numa", policy: NUMAPolicy, devices: disks, size: 2, want: []string{"sde", "sdf"}},
+		{name: "numa largest", policy: NUMAPolicy, devices: disks, size: 4, want: []string{"sda", "sdb", "sdc", "sdd"}},
+		{name: "numa mandatory", policy: NUMAPolicy, devices: disks, mustInclude: []string{"sdd"}, size: 2, want: []string{"sdd", "sda"}},
+		{name: "numa unknown", policy: NUMAPolicy, devices: slots, size: 2, want: []string{"fuse-0", "fuse-1"}},
+		{name: "only mandatory", policy: PackPolicy, devices: disks, mustInclude: []string{"sdb", "sde"}, size: 2, want: []string{"sdb", "sde"}},
+		{name: "not enough devices", policy: SpreadPolicy, devices: slots, size: 5, want: []string{"fuse-0", "fuse-1", "fuse-2"}},
+	}
+
+	Convey("Test preferDevices", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				So(preferDevices(tt.policy, tt.devices, tt.mustInclude, tt.size), ShouldResemble, tt.want)
+			})
+		}
+	})
+}
+
+func Test_preferredAllocation(t *testing.T) {
+	Convey("Test preferredAllocation only picks available devices", t, func() {
+		devs := []allocatable{{id: "sda", controller: "hba0"}, {id: "sdb", controller: "hba0"}, {id: "sdc", controller: "hba1"}}
+		resp := preferredAllocation(SameControllerPolicy, devs, &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+				{AvailableDeviceIDs: []string{"sdb", "sdc"}, AllocationSize: 1},
+				{AvailableDeviceIDs: []string{"sda", "sdb", "sdc"}, MustIncludeDeviceIDs: []string{"sdb"}, AllocationSize: 2},
+			},
+		})
+		So(resp.ContainerResponses, ShouldHaveLength, 2)
+		So(resp.ContainerResponses[0].DeviceIDs, ShouldResemble, []string{"sdb"})
+		So(resp.ContainerResponses[1].DeviceIDs, ShouldResemble, []string{"sdb", "sda"})
+	})
+
+	Convey("Test allocation policy validation", t, func() {
+		So(validateAllocationPolicy(NUMAPolicy, true), ShouldBeNil)
+		So(validateAllocationPolicy(NUMAPolicy, false), ShouldNotBeNil)
+		So(validateAllocationPolicy(SameControllerPolicy, true), ShouldBeNil)
+		So(validateAllocationPolicy(SameControllerPolicy, false), ShouldNotBeNil)
+		So(validateAllocationPolicy("random", true), ShouldNotBeNil)
+	})
+}
@@ -20,152 +20,275 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
-	"os"
-	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"google.golang.org/grpc"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	//pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
-	utilexec "k8s.io/utils/exec"
 )
 
 const (
-	deviceResourceName = "hdls.me/sdx"
-	// deviceRegex is the regex to extract the device name like `sda` from "lsblk -o name"
-	deviceRegex     = `^sd[a-z]+$`
-	blockServerSock = pluginapi.DevicePluginPath + "block.sock"
+	deviceResourceName = "sdx"
+	// deviceRegex selects the whole disks by name, like `sda`, `nvme0n1` or `vda`
+	deviceRegex     = `^(sd[a-z]+|nvme[0-9]+n[0-9]+|vd[a-z]+|xvd[a-z]+)$`
+	blockSocketName = "block.sock"
+	// blockDevicesEnv lists the allocated disks, e.g. "sdb,sdc", in the container.
+	blockDevicesEnv  = "NODE_DEVICE_PLUGIN_BLOCK_DEVICES"
+	defaultSysfsRoot = "/sys"
+	defaultDevRoot   = "/dev"
 )
 
-// BlockDevicePlugin implements the Kubernetes device plugin API
-type BlockDevicePlugin struct {
-	Exec   utilexec.Interface
-	devs   []*pluginapi.Device
-	socket string
-
-	stop   chan interface{}
-	health chan *pluginapi.Device
-
-	server *grpc.Server
+// BlockSpec configures BlockDevicePlugin.
+type BlockSpec struct {
+	Resource   `json:",inline"`
+	SocketName string `json:"socketName,omitempty"`
+	// DeviceRegex selects the disks by name when a selector has no name filter.
+	DeviceRegex string        `json:"deviceRegex,omitempty"`
+	Selector    BlockSelector `json:"selector,omitempty"`
+	// Classes split the disks between several resources, a disk belongs to
+	// the first class it matches. Without classes, the resource, socket and
+	// selector of the spec make the only class.
+	Classes []BlockClass `json:"classes,omitempty"`
+	// Partitions also mounts the partitions of the allocated disks.
+	Partitions bool            `json:"partitions,omitempty"`
+	Health     BlockHealthSpec `json:"health,omitempty"`
+	// SysfsRoot is where sysfs is mounted, defaults to /sys.
+	SysfsRoot string `json:"sysfsRoot,omitempty"`
+	// DevRoot and ProcRoot are where the host /dev and /proc are mounted,
+	// /dev and /proc by default. The host mounts are only seen with the host
+	// /proc or hostPID.
+	DevRoot  string `json:"devRoot,omitempty"`
+	ProcRoot string `json:"procRoot,omitempty"`
+	// AllocationPolicy is the policy of GetPreferredAllocation: pack, spread,
+	// same-controller or numa. kubelet picks the disks itself when it is empty.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
+	// PreStart prepares the disks before the containers using them start.
+	PreStart PreStartSpec `json:"preStart,omitempty"`
+
+	// deviceRegex is DeviceRegex compiled by Validate
+	deviceRegex *regexp.Regexp
 }
 
-var _ DevicePlugin = &BlockDevicePlugin{}
-
-func NewBlockDevicePlugin() (DevicePlugin, error) {
-	devices, err := getBlockDevices(context.Background())
-	if err != nil {
-		return nil, err
-	}
-	return &BlockDevicePlugin{
-		socket: blockServerSock,
-		devs:   devices,
-		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
-	}, err
+// BlockClass advertises the disks matched by Selector as a resource.
+type BlockClass struct {
+	Resource   `json:",inline"`
+	SocketName string        `json:"socketName,omitempty"`
+	Selector   BlockSelector `json:"selector,omitempty"`
+	// AllocationPolicy defaults to the one of the BlockSpec.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
+	// PreStart defaults to the one of the BlockSpec.
+	PreStart *PreStartSpec `json:"preStart,omitempty"`
 }
 
-// Start starts the gRPC server of the device plugin
-func (m *BlockDevicePlugin) Start() error {
-	err := m.cleanup()
-	if err != nil {
+// Validate checks the spec and fills in the defaults.
+func (s *BlockSpec) Validate() error {
+	if err := s.Resource.validate(deviceResourceName); err != nil {
 		return err
 	}
-
-	sock, err := net.Listen("unix", m.socket)
+	if s.SocketName == "" {
+		s.SocketName = blockSocketName
+	}
+	if s.DeviceRegex == "" {
+		s.DeviceRegex = deviceRegex
+	}
+	if s.SysfsRoot == "" {
+		s.SysfsRoot = defaultSysfsRoot
+	}
+	if s.DevRoot == "" {
+		s.DevRoot = defaultDevRoot
+	}
+	if s.ProcRoot == "" {
+		s.ProcRoot = defaultProcRoot
+	}
+	re, err := regexp.Compile(s.DeviceRegex)
 	if err != nil {
+		return fmt.Errorf("invalid device regex %q: %s", s.DeviceRegex, err)
+	}
+	s.deviceRegex = re
+	if err := s.Selector.Validate(); err != nil {
 		return err
 	}
-
-	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	pluginapi.RegisterDevicePluginServer(m.server, m)
-
-	go m.server.Serve(sock)
-
-	// Wait for server to start by launching a blocking connexion
-	conn, err := dial(m.socket, 5*time.Second)
-	if err != nil {
+	if err := s.Health.Validate(); err != nil {
 		return err
 	}
-	conn.Close()
-	go m.healthcheck()
-
+	if err := validateAllocationPolicy(s.AllocationPolicy, true); err != nil {
+		return err
+	}
+	if err := s.PreStart.Validate(); err != nil {
+		return err
+	}
+	for i := range s.Classes {
+		c := &s.Classes[i]
+		if c.ResourceDomain == "" {
+			c.ResourceDomain = s.ResourceDomain
+		}
+		if err := c.Resource.validate(""); err != nil {
+			return fmt.Errorf("class %d: %s", i, err)
+		}
+		if c.SocketName == "" {
+			short := c.ResourceName[strings.Index(c.ResourceName, "/")+1:]
+			c.SocketName = strings.TrimSuffix(s.SocketName, ".sock") + "-" + short + ".sock"
+		}
+		if err := c.Selector.Validate(); err != nil {
+			return fmt.Errorf("class %s: %s", c.ResourceName, err)
+		}
+		if c.AllocationPolicy == "" {
+			c.AllocationPolicy = s.AllocationPolicy
+		}
+		if err := validateAllocationPolicy(c.AllocationPolicy, true); err != nil {
+			return fmt.Errorf("class %s: %s", c.ResourceName, err)
+		}
+		if c.PreStart == nil {
+			preStart := s.PreStart
+			c.PreStart = &preStart
+		}
+		if err := c.PreStart.Validate(); err != nil {
+			return fmt.Errorf("class %s: %s", c.ResourceName, err)
+		}
+	}
 	return nil
 }
 
-// Stop stops the gRPC server
-func (m *BlockDevicePlugin) Stop() error {
-	if m.server == nil {
-		return nil
+// EffectiveClasses returns the classes served for the spec.
+func (s *BlockSpec) EffectiveClasses() []BlockClass {
+	if len(s.Classes) > 0 {
+		return s.Classes
 	}
+	return []BlockClass{{Resource: s.Resource, SocketName: s.SocketName, Selector: s.Selector, AllocationPolicy: s.AllocationPolicy, PreStart: &s.PreStart}}
+}
 
-	m.server.Stop()
-	m.server = nil
-	close(m.stop)
+// classify returns the index of the class of the disk, or -1 if no class
+// selects it. The spec must be validated.
+func (s *BlockSpec) classify(d *BlockDevice) int {
+	for i, c := range s.EffectiveClasses() {
+		if len(c.Selector.Names) == 0 && c.Selector.NameRegex == "" && (s.deviceRegex == nil || !s.deviceRegex.MatchString(d.Name)) {
+			continue
+		}
+		if c.Selector.Matches(d) {
+			return i
+		}
+	}
+	return -1
+}
 
-	return m.cleanup()
+// BlockDevicePlugin implements the Kubernetes device plugin API for one class of a BlockSpec
+type BlockDevicePlugin struct {
+	*pluginServer
+	spec  BlockSpec
+	class int
+
+	// mu protects disks, updated on hotplug along with the registry, and
+	// fresh, the disks allocated since their last successful pre-start
+	mu         sync.RWMutex
+	disks      map[string]*BlockDevice
+	fresh      map[string]bool
+	partitions bool
+	sysfsRoot  string
+
+	registry *deviceRegistry
+	uevents  func() (UeventSource, error)
+	// udevRetryDelay is the delay between the evaluations of a new disk
+	// waiting for its udev links.
+	udevRetryDelay time.Duration
 }
 
-// Register registers the device plugin for the given resourceName with Kubelet.
-func (m *BlockDevicePlugin) Register(kubeletEndpoint, resourceName string) error {
-	conn, err := dial(kubeletEndpoint, 5*time.Second)
+var _ DevicePlugin = &BlockDevicePlugin{}
+
+// NewBlockDevicePlugin returns a BlockDevicePlugin, or a group of them when
+// the spec has several classes.
+func NewBlockDevicePlugin(spec BlockSpec) (DevicePlugin, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	disks, err := getBlockDevices(spec.SysfsRoot, spec.ProcRoot, spec.DevRoot)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer conn.Close()
 
-	client := pluginapi.NewRegistrationClient(conn)
-	reqt := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(m.socket),
-		ResourceName: resourceName,
+	var group pluginGroup
+	for i := range spec.EffectiveClasses() {
+		group = append(group, newBlockClassPlugin(spec, i, disks))
 	}
+	if len(group) == 1 {
+		return group[0], nil
+	}
+	return group, nil
+}
 
-	_, err = client.Register(context.Background(), reqt)
-	if err != nil {
-		return err
+// newBlockClassPlugin returns the plugin of the class of spec, serving the disks of that class.
+func newBlockClassPlugin(spec BlockSpec, class int, disks []*BlockDevice) *BlockDevicePlugin {
+	c := spec.EffectiveClasses()[class]
+	m := &BlockDevicePlugin{
+		spec:       spec,
+		class:      class,
+		disks:      map[string]*BlockDevice{},
+		fresh:      map[string]bool{},
+		partitions: spec.Partitions,
+		sysfsRoot:  spec.SysfsRoot,
+		uevents:    newNetlinkUeventSource,
+
+		udevRetryDelay: udevRetryDelay,
 	}
-	return nil
+	var devs []*pluginapi.Device
+	var names []string
+	for _, d := range disks {
+		if spec.classify(d) != class {
+			continue
+		}
+		m.disks[d.Name] = d
+		devs = append(devs, blockPluginDevice(d))
+		names = append(names, d.Name)
+	}
+	m.registry = newDeviceRegistry(devs)
+	log.Printf("%s devices: %v", c.ResourceName, names)
+	m.pluginServer = newPluginServer(c.ResourceName, c.SocketName, m)
+	return m
 }
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *BlockDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	return m.listAndWatch(m.registry, s)
+}
 
-	for {
-		select {
-		case <-m.stop:
-			return nil
-		case d := <-m.health:
-			d.Health = pluginapi.Unhealthy
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
-		}
-	}
+// devices returns a copy of the advertised devices.
+func (m *BlockDevicePlugin) devices() []*pluginapi.Device {
+	return m.registry.snapshot().devices
 }
 
 // Allocate which return list of devices.
 func (m *BlockDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	log.Printf("req: %v", reqs)
-	devs := m.devs
 	var responses pluginapi.AllocateResponse
 
 	for _, req := range reqs.ContainerRequests {
 		response := new(pluginapi.ContainerAllocateResponse)
 		for _, id := range req.DevicesIDs {
 			log.Printf("Allocate device: %s", id)
-			if !deviceExists(devs, id) {
+			if _, ok := m.registry.get(id); !ok {
 				return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
 			}
-			response.Devices = []*pluginapi.DeviceSpec{
-				{
-					ContainerPath: fmt.Sprintf("/dev/%s", id),
-					HostPath:      fmt.Sprintf("/dev/%s", id),
-					Permissions:   "rwm",
-				},
+			response.Devices = append(response.Devices, blockDeviceSpec(id))
+			if !m.partitions {
+				continue
 			}
+			parts, err := getPartitions(m.sysfsRoot, id)
+			if err != nil {
+				return nil, fmt.Errorf("list partitions of %s: %s", id, err)
+			}
+			for _, part := range parts {
+				response.Devices = append(response.Devices, blockDeviceSpec(part))
+			}
+		}
+		response.Envs = map[string]string{
+			blockDevicesEnv: strings.Join(req.DevicesIDs, ","),
 		}
+		m.mu.Lock()
+		for _, id := range req.DevicesIDs {
+			m.fresh[id] = true
+		}
+		m.mu.Unlock()
 
 		responses.ContainerResponses = append(responses.ContainerResponses, response)
 	}
@@ -174,73 +297,130 @@ func (m *BlockDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloca
 }
 
 func (m *BlockDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                len(m.preStart().Actions) > 0,
+		GetPreferredAllocationAvailable: m.allocationPolicy() != "",
+	}, nil
 }
 
-func (m *BlockDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+// PreStartContainer runs the pre-start actions on the disks of the container,
+// a failure fails the start of the container. kubelet calls it before every
+// start of a container, the destructive actions only run on the first one
+// after Allocate.
+func (m *BlockDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	runner := &preStartRunner{
+		spec:       *m.preStart(),
+		sysfsRoot:  m.spec.SysfsRoot,
+		procRoot:   m.spec.ProcRoot,
+		devRoot:    m.spec.DevRoot,
+		partitions: m.partitions,
+		fresh:      map[string]bool{},
+	}
+	m.mu.RLock()
+	for _, id := range req.DevicesIDs {
+		runner.fresh[id] = m.fresh[id]
+	}
+	m.mu.RUnlock()
+	if err := runner.run(req.DevicesIDs); err != nil {
+		log.Printf("%s pre-start of %v failed: %s", m.resourceName, req.DevicesIDs, err)
+		return nil, err
+	}
+	m.mu.Lock()
+	for _, id := range req.DevicesIDs {
+		delete(m.fresh, id)
+	}
+	m.mu.Unlock()
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
-func (m *BlockDevicePlugin) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return &pluginapi.PreferredAllocationResponse{}, nil
+func (m *BlockDevicePlugin) preStart() *PreStartSpec {
+	return m.spec.EffectiveClasses()[m.class].PreStart
 }
 
-func (m *BlockDevicePlugin) cleanup() error {
-	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
-		return err
+func (m *BlockDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	var devs []allocatable
+	for _, d := range m.devices() {
+		a := allocatableDevice(d)
+		m.mu.RLock()
+		if disk, ok := m.disks[d.ID]; ok {
+			a.controller = disk.Controller
+		}
+		m.mu.RUnlock()
+		devs = append(devs, a)
 	}
+	return preferredAllocation(m.allocationPolicy(), devs, reqs), nil
+}
 
-	return nil
+func (m *BlockDevicePlugin) allocationPolicy() string {
+	return m.spec.EffectiveClasses()[m.class].AllocationPolicy
 }
 
-func (m *BlockDevicePlugin) healthcheck() {
-	for range m.stop {
-		return
+// healthcheck periodically checks the disks and updates their health in the registry.
+func (m *BlockDevicePlugin) healthcheck(stop <-chan interface{}) {
+	checker := newBlockHealthChecker(m.spec.Health, m.spec.SysfsRoot, m.spec.DevRoot)
+	ticker := time.NewTicker(m.spec.Health.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, d := range m.devices() {
+			healthy, changed, reason := checker.update(d.ID)
+			if !changed {
+				continue
+			}
+			health := pluginapi.Healthy
+			if !healthy {
+				health = pluginapi.Unhealthy
+				log.Printf("%s device %s is unhealthy: %s", m.resourceName, d.ID, reason)
+			} else {
+				log.Printf("%s device %s is healthy again", m.resourceName, d.ID)
+			}
+			m.registry.setHealth(d.ID, health)
+		}
 	}
 }
 
-// Serve starts the gRPC server and register the device plugin to Kubelet
-func (m *BlockDevicePlugin) Serve() error {
-	err := m.Start()
-	if err != nil {
-		log.Printf("Could not start device plugin: %s", err)
-		return err
+// blockPluginDevice returns the healthy device advertised for a disk, with
+// its NUMA node when known.
+func blockPluginDevice(d *BlockDevice) *pluginapi.Device {
+	dev := &pluginapi.Device{ID: d.Name, Health: pluginapi.Healthy}
+	if d.NUMANode >= 0 {
+		dev.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(d.NUMANode)}}}
 	}
-	log.Println("Starting to serve on", m.socket)
+	return dev
+}
 
-	err = m.Register(pluginapi.KubeletSocket, deviceResourceName)
-	if err != nil {
-		log.Printf("Could not register device plugin: %s", err)
-		m.Stop()
-		return err
+func blockDeviceSpec(name string) *pluginapi.DeviceSpec {
+	return &pluginapi.DeviceSpec{
+		ContainerPath: fmt.Sprintf("/dev/%s", name),
+		HostPath:      fmt.Sprintf("/dev/%s", name),
+		Permissions:   "rwm",
 	}
-	log.Println("Registered device plugin with Kubelet")
-
-	return nil
 }
 
-func getBlockDevices(ctx context.Context) ([]*pluginapi.Device, error) {
-	devices := []*pluginapi.Device{}
-	exec := utilexec.New()
-	output, err := exec.CommandContext(ctx, "lsblk", "-l", "-o", "NAME,MOUNTPOINT").CombinedOutput()
+// getBlockDevices returns the physical disks that are not used by the host.
+func getBlockDevices(sysfsRoot, procRoot, devRoot string) ([]*BlockDevice, error) {
+	disks, err := discoverBlockDevices(sysfsRoot)
 	if err != nil {
 		return nil, err
 	}
-	res := string(output)
-	strs := strings.Split(res, "\n")
-	deviceMatchExp := regexp.MustCompile(deviceRegex)
-	for _, s := range strs {
-		ss := strings.Split(s, " ")
-		if len(ss) == 1 || strings.TrimSpace(ss[1]) == "" {
-			device := deviceMatchExp.FindString(strings.TrimSpace(s))
-			if device != "" {
-				devices = append(devices, &pluginapi.Device{
-					ID:     device,
-					Health: pluginapi.Healthy,
-				})
-			}
+	readDiskLinks(devRoot, disks)
+	safety, err := newSafetyAnalyzer(sysfsRoot, procRoot, devRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []*BlockDevice
+	for _, d := range disks {
+		if reason := safety.inUse(d); reason != "" {
+			log.Printf("skip device %s: %s", d.Name, reason)
+			continue
 		}
+		devices = append(devices, d)
 	}
-	log.Printf("devices: %v", devices)
 	return devices, nil
 }
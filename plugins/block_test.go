@@ -18,44 +18,122 @@ package plugins
 
 import (
 	"context"
-	"os/exec"
-	"reflect"
+	"os"
+	"path/filepath"
 	"testing"
 
-	. "github.com/agiledragon/gomonkey"
 	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func Test_getBlockDevices(t *testing.T) {
-	Convey("Test juicefs status", t, func() {
-		Convey("normal", func() {
-			var tmpCmd = &exec.Cmd{}
-			patch := ApplyMethod(reflect.TypeOf(tmpCmd), "CombinedOutput", func(_ *exec.Cmd) ([]byte, error) {
-				return []byte(`NAME                  MOUNTPOINT
-loop0
-loop1
-loop3
-loop4
-loop5
-loop6
-loop7
-loop8
-sda
-sda1
-sda2
-sda3
-sda4
-sdb
-sdc
-sr0
-ubuntu--vg-ubuntu--lv /var/lib/kubelet/device-plugins
-ubuntu--vg-ubuntu--lv /var/lib/kubelet/device-plugins`), nil
-			})
-			defer patch.Reset()
+	disk := func(name, dev string) fakeDisk {
+		return fakeDisk{name: name, path: "pci0000:00/0000:00:1f.2/ata1", attrs: map[string]string{"dev": dev}}
+	}
+	sysfs := newFakeSysfs(t,
+		disk("sda", "8:0"), disk("sdb", "8:16"), disk("sdc", "8:32"), disk("sr0", "11:0"),
+		disk("nvme0n1", "259:0"), disk("vda", "252:0"), disk("xvdf", "202:80"),
+		fakeDisk{name: "loop0", path: "virtual", attrs: map[string]string{"dev": "7:0"}},
+	)
+	proc := newFakeProc(t, `22 1 8:32 / /data rw,relatime shared:1 - ext4 /dev/sdc rw
+23 1 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+`, "Filename\tType\tSize\tUsed\tPriority\n")
 
-			devs, err := getBlockDevices(context.Background())
+	Convey("Test get block devices", t, func() {
+		Convey("normal", func() {
+			devs, err := getBlockDevices(sysfs, proc, t.TempDir())
 			So(err, ShouldBeNil)
-			So(len(devs), ShouldEqual, 3)
+			var names []string
+			for _, d := range devs {
+				names = append(names, d.Name)
+			}
+			So(names, ShouldResemble, []string{"nvme0n1", "sda", "sdb", "sr0", "vda", "xvdf"})
+		})
+		Convey("default regex", func() {
+			spec := BlockSpec{}
+			So(spec.Validate(), ShouldBeNil)
+			devs, err := getBlockDevices(sysfs, proc, t.TempDir())
+			So(err, ShouldBeNil)
+			var names []string
+			for _, d := range devs {
+				if spec.classify(d) == 0 {
+					names = append(names, d.Name)
+				}
+			}
+			So(names, ShouldResemble, []string{"nvme0n1", "sda", "sdb", "vda", "xvdf"})
 		})
 	})
 }
+
+func TestBlockDevicePlugin_Allocate(t *testing.T) {
+	sysfs := newFakeSysfs(t,
+		fakeDisk{name: "sdb", path: "ata1", parts: map[string]map[string]string{"sdb1": nil, "sdb2": nil}},
+		fakeDisk{name: "sdc", path: "ata1", parts: map[string]map[string]string{"sdc1": nil}},
+		fakeDisk{name: "sdd", path: "ata1"},
+	)
+
+	tests := []struct {
+		name       string
+		ids        []string
+		partitions bool
+		wantPaths  []string
+		wantEnv    string
+		wantErr    bool
+	}{
+		{name: "one device", ids: []string{"sdb"}, wantPaths: []string{"/dev/sdb"}, wantEnv: "sdb"},
+		{name: "two devices", ids: []string{"sdb", "sdc"}, wantPaths: []string{"/dev/sdb", "/dev/sdc"}, wantEnv: "sdb,sdc"},
+		{name: "three devices", ids: []string{"sdb", "sdc", "sdd"}, wantPaths: []string{"/dev/sdb", "/dev/sdc", "/dev/sdd"}, wantEnv: "sdb,sdc,sdd"},
+		{
+			name:       "with partitions",
+			ids:        []string{"sdb", "sdc", "sdd"},
+			partitions: true,
+			wantPaths:  []string{"/dev/sdb", "/dev/sdb1", "/dev/sdb2", "/dev/sdc", "/dev/sdc1", "/dev/sdd"},
+			wantEnv:    "sdb,sdc,sdd",
+		},
+		{name: "unknown device", ids: []string{"sdb", "sdz"}, wantErr: true},
+	}
+
+	Convey("Test block device allocate", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				m := &BlockDevicePlugin{
+					registry: newDeviceRegistry([]*pluginapi.Device{
+						{ID: "sdb", Health: pluginapi.Healthy},
+						{ID: "sdc", Health: pluginapi.Healthy},
+						{ID: "sdd", Health: pluginapi.Healthy},
+					}),
+					fresh:      map[string]bool{},
+					partitions: tt.partitions,
+					sysfsRoot:  sysfs,
+				}
+				resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+					ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: tt.ids}},
+				})
+				if tt.wantErr {
+					So(err, ShouldNotBeNil)
+					return
+				}
+				So(err, ShouldBeNil)
+				So(resp.ContainerResponses, ShouldHaveLength, 1)
+				var paths []string
+				for _, d := range resp.ContainerResponses[0].Devices {
+					So(d.ContainerPath, ShouldEqual, d.HostPath)
+					So(d.Permissions, ShouldEqual, "rwm")
+					paths = append(paths, d.HostPath)
+				}
+				So(paths, ShouldResemble, tt.wantPaths)
+				So(resp.ContainerResponses[0].Envs[blockDevicesEnv], ShouldEqual, tt.wantEnv)
+			})
+		}
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultCharDeviceHealthInterval = 10 * time.Second
+
+// HealthSpec configures the periodic health check of a device node.
+type HealthSpec struct {
+	// Interval between two checks, e.g. "10s".
+	Interval string `json:"interval,omitempty"`
+}
+
+// Validate checks the spec and fills in the defaults.
+func (s *HealthSpec) Validate() error {
+	return validateInterval(&s.Interval, defaultCharDeviceHealthInterval)
+}
+
+func (s *HealthSpec) interval() time.Duration {
+	return parseInterval(s.Interval)
+}
+
+// checkCharDevice checks that path is the character device major:minor and
+// that it can be opened. The device cgroup of a non-privileged container, the
+// plugin's own, refuses the open with EPERM: the node is then only checked to
+// be present, the pods getting the device are allowed to open it.
+func checkCharDevice(path string, major, minor uint32) error {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return fmt.Errorf("%s is not a character device", path)
+	}
+	rdev := uint64(st.Rdev)
+	if unix.Major(rdev) != major || unix.Minor(rdev) != minor {
+		return fmt.Errorf("%s is device %d:%d, expected %d:%d", path, unix.Major(rdev), unix.Minor(rdev), major, minor)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, unix.EPERM) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,43 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_checkCharDevice(t *testing.T) {
+	Convey("Test checkCharDevice", t, func() {
+		Convey("char device", func() {
+			So(checkCharDevice("/dev/null", 1, 3), ShouldBeNil)
+		})
+		Convey("wrong numbers", func() {
+			So(checkCharDevice("/dev/null", fuseMajor, fuseMinor), ShouldNotBeNil)
+		})
+		Convey("regular file", func() {
+			path := filepath.Join(t.TempDir(), "fuse")
+			writeFile(t, path, "")
+			So(checkCharDevice(path, fuseMajor, fuseMinor), ShouldNotBeNil)
+		})
+		Convey("missing", func() {
+			So(checkCharDevice(filepath.Join(t.TempDir(), "fuse"), fuseMajor, fuseMinor), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,234 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/zwwhdls/node-device-plugin/plugins/kubelettest"
+)
+
+// serve serves p with the fake kubelet k and returns it as registered.
+func serve(t *testing.T, k *kubelettest.Kubelet, p DevicePlugin, resourceName string) *kubelettest.Plugin {
+	t.Helper()
+	p.SetPaths(Paths{PluginDir: k.Dir, KubeletSocket: k.Socket})
+	if err := p.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Stop() })
+	registered, err := k.WaitForPlugin(resourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registered
+}
+
+func TestFuseDevicePlugin_e2e(t *testing.T) {
+	Convey("Test fuse device plugin with kubelet", t, func() {
+		k := kubelettest.New(t)
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 3, AllocationPolicy: PackPolicy}})
+		So(err, ShouldBeNil)
+		fuse := serve(t, k, p, "hdls.me/fuse")
+
+		So(k.Requests(), ShouldHaveLength, 1)
+		So(k.Requests()[0].Endpoint, ShouldEqual, "fuse.sock")
+		So(fuse.Options.GetPreferredAllocationAvailable, ShouldBeTrue)
+
+		devices, err := fuse.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 3 })
+		So(err, ShouldBeNil)
+
+		resp, err := fuse.Allocate(devices[0].ID)
+		So(err, ShouldBeNil)
+		So(resp.Devices, ShouldResemble, []*pluginapi.DeviceSpec{{ContainerPath: "/dev/fuse", HostPath: "/dev/fuse", Permissions: "rwm"}})
+		_, err = fuse.Allocate("unknown")
+		So(err, ShouldNotBeNil)
+
+		So(p.(Resizer).Resize(5), ShouldBeNil)
+		_, err = fuse.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 5 })
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestTunDevicePlugin_e2e(t *testing.T) {
+	Convey("Test tun device plugin with kubelet", t, func() {
+		p, err := NewTunDevicePlugin(TunSpec{SlotSpec: SlotSpec{Slots: 2}})
+		So(err, ShouldBeNil)
+		tun := serve(t, kubelettest.New(t), p, "hdls.me/tun")
+
+		So(tun.Request.Endpoint, ShouldEqual, "tun.sock")
+		devices, err := tun.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 2 })
+		So(err, ShouldBeNil)
+
+		resp, err := tun.Allocate(devices[0].ID)
+		So(err, ShouldBeNil)
+		So(resp.Devices, ShouldResemble, []*pluginapi.DeviceSpec{{ContainerPath: "/dev/net/tun", HostPath: "/dev/net/tun", Permissions: "rwm"}})
+	})
+}
+
+func TestGenericDevicePlugin_e2e(t *testing.T) {
+	Convey("Test generic device plugin with kubelet", t, func() {
+		k := kubelettest.New(t)
+		p, err := NewGenericDevicePlugin(GenericSpec{
+			Name:     "kvm",
+			Resource: Resource{ResourceName: "example.com/kvm"},
+			Devices:  []DeviceMount{{HostPath: "/dev/kvm"}},
+			Slots:    2,
+		})
+		So(err, ShouldBeNil)
+		kvm := serve(t, k, p, "example.com/kvm")
+
+		devices, err := kvm.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 2 })
+		So(err, ShouldBeNil)
+		So(kvm.Options.GetPreferredAllocationAvailable, ShouldBeFalse)
+
+		resp, err := kvm.Allocate(devices[1].ID)
+		So(err, ShouldBeNil)
+		So(resp.Devices[0].HostPath, ShouldEqual, "/dev/kvm")
+	})
+}
+
+func TestBlockDevicePlugin_e2e(t *testing.T) {
+	Convey("Test block device plugin with kubelet", t, func() {
+		sysfs := newFakeSysfs(t,
+			fakeDisk{name: "sdb", path: "pci0000:00/0000:00:1f.2/ata2", attrs: map[string]string{"dev": "8:16"}},
+			fakeDisk{name: "sdc", path: "pci0000:00/0000:00:1f.2/ata3", attrs: map[string]string{"dev": "8:32"}},
+			fakeDisk{name: "nvme0n1", path: "pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0", attrs: map[string]string{"dev": "259:0"}},
+		)
+		proc := newFakeProc(t, "", "")
+		dev := t.TempDir()
+
+		p, err := NewBlockDevicePlugin(BlockSpec{
+			Resource:         Resource{ResourceName: "disk"},
+			SysfsRoot:        sysfs,
+			ProcRoot:         proc,
+			DevRoot:          dev,
+			AllocationPolicy: SameControllerPolicy,
+			PreStart:         PreStartSpec{Actions: []PreStartAction{{Type: VerifyUnusedAction}}},
+		})
+		So(err, ShouldBeNil)
+		block := p.(*BlockDevicePlugin)
+		source := &fakeUeventSource{events: make(chan Uevent)}
+		block.uevents = func() (UeventSource, error) { return source, nil }
+		disks := serve(t, kubelettest.New(t), p, "hdls.me/disk")
+
+		So(disks.Options.PreStartRequired, ShouldBeTrue)
+		devices, err := disks.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 3 })
+		So(err, ShouldBeNil)
+		So(kubelettest.Healthy(devices), ShouldResemble, []string{"nvme0n1", "sdb", "sdc"})
+
+		preferred, err := disks.Client.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+				{AvailableDeviceIDs: []string{"nvme0n1", "sdb", "sdc"}, AllocationSize: 2},
+			},
+		})
+		So(err, ShouldBeNil)
+		So(preferred.ContainerResponses[0].DeviceIDs, ShouldResemble, []string{"sdb", "sdc"})
+
+		resp, err := disks.Allocate("sdb", "sdc")
+		So(err, ShouldBeNil)
+		So(resp.Envs[blockDevicesEnv], ShouldEqual, "sdb,sdc")
+
+		for _, name := range []string{"sdb", "sdc"} {
+			writeFile(t, filepath.Join(dev, name), "")
+		}
+		_, err = disks.Client.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{"sdb", "sdc"}})
+		So(err, ShouldBeNil)
+
+		So(os.Remove(filepath.Join(sysfs, "block", "sdc")), ShouldBeNil)
+		source.events <- Uevent{Action: "remove", Subsystem: "block", DevType: "disk", DevName: "sdc"}
+		devices, err = disks.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 2 })
+		So(err, ShouldBeNil)
+		So(kubelettest.Healthy(devices), ShouldResemble, []string{"nvme0n1", "sdb"})
+	})
+}
+
+func TestPluginServer_ListAndWatchStreams(t *testing.T) {
+	Convey("Test several ListAndWatch streams get every update", t, func() {
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 1}})
+		So(err, ShouldBeNil)
+		fuse := serve(t, kubelettest.New(t), p, "hdls.me/fuse")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var streams []pluginapi.DevicePlugin_ListAndWatchClient
+		for i := 0; i < 2; i++ {
+			stream, err := fuse.Client.ListAndWatch(ctx, &pluginapi.Empty{})
+			So(err, ShouldBeNil)
+			resp, err := stream.Recv()
+			So(err, ShouldBeNil)
+			So(resp.Devices, ShouldHaveLength, 1)
+			streams = append(streams, stream)
+		}
+
+		So(p.(Resizer).Resize(2), ShouldBeNil)
+		for _, stream := range streams {
+			resp, err := stream.Recv()
+			So(err, ShouldBeNil)
+			So(resp.Devices, ShouldHaveLength, 2)
+		}
+		_, err = fuse.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 2 })
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestPluginServer_Drain(t *testing.T) {
+	Convey("Test draining the devices before stopping", t, func() {
+		p, err := NewGenericDevicePlugin(GenericSpec{
+			Name:     "kvm",
+			Resource: Resource{ResourceName: "kvm"},
+			Devices:  []DeviceMount{{HostPath: "/dev/kvm"}},
+			Slots:    2,
+		})
+		So(err, ShouldBeNil)
+		kvm := serve(t, kubelettest.New(t), p, "hdls.me/kvm")
+		_, err = kvm.WaitForDevices(func(d []*pluginapi.Device) bool { return len(kubelettest.Healthy(d)) == 2 })
+		So(err, ShouldBeNil)
+
+		p.(Drainer).Drain()
+		p.(Drainer).Drain()
+		devices, err := kvm.WaitForDevices(func(d []*pluginapi.Device) bool { return len(kubelettest.Healthy(d)) == 0 })
+		So(err, ShouldBeNil)
+		So(devices, ShouldHaveLength, 2)
+		So(p.Stop(), ShouldBeNil)
+	})
+}
+
+func TestPluginServer_kubeletRestart(t *testing.T) {
+	Convey("Test registering again after a kubelet restart", t, func() {
+		k := kubelettest.New(t)
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 1}})
+		So(err, ShouldBeNil)
+		serve(t, k, p, "hdls.me/fuse")
+
+		k.Restart()
+		So(p.(SocketChecker).CheckSocket(), ShouldNotBeNil)
+
+		So(p.Stop(), ShouldBeNil)
+		p, err = NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 1}})
+		So(err, ShouldBeNil)
+		fuse := serve(t, k, p, "hdls.me/fuse")
+		_, err = fuse.WaitForDevices(func(d []*pluginapi.Device) bool { return len(d) == 1 })
+		So(err, ShouldBeNil)
+		So(k.Requests(), ShouldHaveLength, 2)
+	})
+}
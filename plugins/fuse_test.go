@@ -0,0 +1,121 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestFuseDevicePlugin_updateHealth(t *testing.T) {
+	Convey("Test fuse slots health", t, func() {
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 3}})
+		So(err, ShouldBeNil)
+		m := p.(*FuseDevicePlugin)
+
+		healths := func() []string {
+			var hs []string
+			for _, d := range m.devices() {
+				hs = append(hs, d.Health)
+			}
+			return hs
+		}
+		So(healths(), ShouldResemble, []string{pluginapi.Healthy, pluginapi.Healthy, pluginapi.Healthy})
+		version := m.registry.snapshot().version
+
+		m.updateHealth(errors.New("no such file"))
+		So(healths(), ShouldResemble, []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Unhealthy})
+		So(m.registry.snapshot().version, ShouldEqual, version+1)
+
+		m.updateHealth(errors.New("no such file"))
+		So(m.registry.snapshot().version, ShouldEqual, version+1)
+
+		m.updateHealth(nil)
+		So(healths(), ShouldResemble, []string{pluginapi.Healthy, pluginapi.Healthy, pluginapi.Healthy})
+		So(m.registry.snapshot().version, ShouldEqual, version+2)
+	})
+}
+
+func TestFuseDevicePlugin_Resize(t *testing.T) {
+	Convey("Test fuse slots resize", t, func() {
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 4}})
+		So(err, ShouldBeNil)
+		m := p.(*FuseDevicePlugin)
+		ids := func() map[string]string {
+			hs := map[string]string{}
+			for _, d := range m.devices() {
+				hs[d.ID] = d.Health
+			}
+			return hs
+		}
+		devs := getSlotDevices("fuse", 6)
+		version := m.registry.snapshot().version
+
+		Convey("grow", func() {
+			So(m.Resize(6), ShouldBeNil)
+			So(m.devices(), ShouldHaveLength, 6)
+			So(m.registry.snapshot().version, ShouldEqual, version+1)
+		})
+
+		Convey("shrink keeps the allocated slots", func() {
+			_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{devs[1].ID, devs[3].ID}}},
+			})
+			So(err, ShouldBeNil)
+			// listed before the allocation
+			m.UpdateAllocations(Allocations{})
+
+			So(m.Resize(2), ShouldBeNil)
+			So(ids(), ShouldResemble, map[string]string{
+				devs[0].ID: pluginapi.Healthy,
+				devs[1].ID: pluginapi.Healthy,
+				devs[3].ID: pluginapi.Unhealthy,
+			})
+			So(m.registry.snapshot().version, ShouldEqual, version+1)
+
+			m.UpdateAllocations(Allocations{"hdls.me/fuse": {devs[3].ID: {Pod: "a"}}})
+			So(m.registry.snapshot().version, ShouldEqual, version+1)
+			// the allocations are not recent anymore
+			for id := range m.recent {
+				m.recent[id] = time.Now().Add(-allocationGracePeriod)
+			}
+			m.UpdateAllocations(Allocations{"hdls.me/fuse": {devs[0].ID: {Pod: "b"}}})
+			So(ids(), ShouldResemble, map[string]string{
+				devs[0].ID: pluginapi.Healthy,
+				devs[1].ID: pluginapi.Healthy,
+			})
+			So(m.registry.snapshot().version, ShouldEqual, version+2)
+		})
+
+		Convey("shrink is refused while the allocations are unknown", func() {
+			So(m.Resize(2), ShouldNotBeNil)
+			So(m.devices(), ShouldHaveLength, 4)
+			So(m.Resize(5), ShouldBeNil)
+			So(m.devices(), ShouldHaveLength, 5)
+		})
+
+		Convey("invalid", func() {
+			So(m.Resize(0), ShouldNotBeNil)
+			So(m.devices(), ShouldHaveLength, 4)
+		})
+	})
+}
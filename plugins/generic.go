@@ -0,0 +1,178 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const defaultPermissions = "rwm"
+
+// DeviceMount describes a host device node and how it appears in the container.
+type DeviceMount struct {
+	// HostPath is the device node on the host, e.g. /dev/net/tun.
+	HostPath string `json:"hostPath"`
+	// ContainerPath defaults to HostPath.
+	ContainerPath string `json:"containerPath,omitempty"`
+	// Permissions is the cgroup device permission string, defaults to "rwm".
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// GenericSpec declares a device that is shared between pods through a fixed
+// number of virtual slots, every slot mounting the same host device nodes.
+type GenericSpec struct {
+	// Name identifies the device; it prefixes the slot IDs and defaults SocketName.
+	Name     string `json:"name"`
+	Resource `json:",inline"`
+	// SocketName is the socket file created in the device plugin directory.
+	SocketName string        `json:"socketName,omitempty"`
+	Devices    []DeviceMount `json:"devices"`
+	// Slots is the number of pods that can use the device at the same time.
+	Slots int `json:"slots"`
+	// AllocationPolicy is pack or spread, as for SlotSpec.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
+}
+
+// Validate checks the spec and fills in the defaults.
+func (s *GenericSpec) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("device name is required")
+	}
+	if err := s.Resource.validate(""); err != nil {
+		return fmt.Errorf("device %s: %s", s.Name, err)
+	}
+	if s.SocketName == "" {
+		s.SocketName = s.Name + ".sock"
+	}
+	if len(s.Devices) == 0 {
+		return fmt.Errorf("device %s: at least one host device path is required", s.Name)
+	}
+	for i := range s.Devices {
+		d := &s.Devices[i]
+		if d.HostPath == "" {
+			return fmt.Errorf("device %s: host path is required", s.Name)
+		}
+		if d.ContainerPath == "" {
+			d.ContainerPath = d.HostPath
+		}
+		if d.Permissions == "" {
+			d.Permissions = defaultPermissions
+		}
+	}
+	if s.Slots <= 0 {
+		return fmt.Errorf("device %s: slots must be positive, got %d", s.Name, s.Slots)
+	}
+	if err := validateAllocationPolicy(s.AllocationPolicy, false); err != nil {
+		return fmt.Errorf("device %s: %s", s.Name, err)
+	}
+	return nil
+}
+
+// GenericDevicePlugin implements the Kubernetes device plugin API for a GenericSpec
+type GenericDevicePlugin struct {
+	*pluginServer
+	spec     GenericSpec
+	registry *deviceRegistry
+}
+
+var _ DevicePlugin = &GenericDevicePlugin{}
+
+func NewGenericDevicePlugin(spec GenericSpec) (DevicePlugin, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	m := &GenericDevicePlugin{
+		spec:     spec,
+		registry: newDeviceRegistry(getSlotDevices(spec.Name, spec.Slots)),
+	}
+	m.pluginServer = newPluginServer(spec.ResourceName, spec.SocketName, m)
+	return m, nil
+}
+
+// ListAndWatch lists devices and update that list according to the health status
+func (m *GenericDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return m.listAndWatch(m.registry, s)
+}
+
+// devices returns a copy of the advertised devices, they never change.
+func (m *GenericDevicePlugin) devices() []*pluginapi.Device {
+	return m.registry.snapshot().devices
+}
+
+// Allocate which return list of devices.
+func (m *GenericDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	var responses pluginapi.AllocateResponse
+
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			log.Printf("Allocate %s device: %s", m.resourceName, id)
+			if _, ok := m.registry.get(id); !ok {
+				return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
+			}
+		}
+		response := new(pluginapi.ContainerAllocateResponse)
+		for _, d := range m.spec.Devices {
+			response.Devices = append(response.Devices, &pluginapi.DeviceSpec{
+				ContainerPath: d.ContainerPath,
+				HostPath:      d.HostPath,
+				Permissions:   d.Permissions,
+			})
+		}
+
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+
+	return &responses, nil
+}
+
+func (m *GenericDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{GetPreferredAllocationAvailable: m.spec.AllocationPolicy != ""}, nil
+}
+
+func (m *GenericDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+func (m *GenericDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	var devs []allocatable
+	for _, d := range m.devices() {
+		devs = append(devs, allocatableDevice(d))
+	}
+	return preferredAllocation(m.spec.AllocationPolicy, devs, reqs), nil
+}
+
+// getSlotDevices returns number virtual devices named <name>-<hostname>-<i>.
+func getSlotDevices(name string, number int) []*pluginapi.Device {
+	hostname, _ := os.Hostname()
+	devs := []*pluginapi.Device{}
+	for i := 0; i < number; i++ {
+		devs = append(devs, &pluginapi.Device{
+			ID:     slotDeviceID(name, hostname, i),
+			Health: pluginapi.Healthy,
+		})
+	}
+	return devs
+}
+
+func slotDeviceID(name, hostname string, i int) string {
+	return fmt.Sprintf("%s-%s-%d", name, hostname, i)
+}
@@ -0,0 +1,71 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestGenericDevicePlugin(t *testing.T) {
+	Convey("Test generic device plugin", t, func() {
+		Convey("invalid spec", func() {
+			_, err := NewGenericDevicePlugin(GenericSpec{Name: "tun", Resource: Resource{ResourceName: "example.com/tun"}, Slots: 1})
+			So(err, ShouldNotBeNil)
+			_, err = NewGenericDevicePlugin(GenericSpec{
+				Name:     "tun",
+				Resource: Resource{ResourceName: "example.com/tun"},
+				Devices:  []DeviceMount{{HostPath: "/dev/net/tun"}},
+			})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("allocate", func() {
+			p, err := NewGenericDevicePlugin(GenericSpec{
+				Name:     "kvm",
+				Resource: Resource{ResourceName: "example.com/kvm"},
+				Devices: []DeviceMount{
+					{HostPath: "/dev/kvm"},
+					{HostPath: "/dev/vhost-net", ContainerPath: "/dev/vhost", Permissions: "rw"},
+				},
+				Slots: 2,
+			})
+			So(err, ShouldBeNil)
+			m := p.(*GenericDevicePlugin)
+			So(m.socket, ShouldEqual, pluginapi.DevicePluginPath+"kvm.sock")
+			devs := m.devices()
+			So(len(devs), ShouldEqual, 2)
+
+			resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{devs[1].ID}}},
+			})
+			So(err, ShouldBeNil)
+			So(resp.ContainerResponses, ShouldHaveLength, 1)
+			So(resp.ContainerResponses[0].Devices, ShouldResemble, []*pluginapi.DeviceSpec{
+				{HostPath: "/dev/kvm", ContainerPath: "/dev/kvm", Permissions: "rwm"},
+				{HostPath: "/dev/vhost-net", ContainerPath: "/dev/vhost", Permissions: "rw"},
+			})
+
+			_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"unknown"}}},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
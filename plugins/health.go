@@ -0,0 +1,159 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const defaultHealthInterval = 30 * time.Second
+
+// BlockHealthSpec configures the periodic health check of the block devices.
+type BlockHealthSpec struct {
+	// Interval between two checks, e.g. "30s".
+	Interval string `json:"interval,omitempty"`
+	// IOErrorThreshold is the number of new I/O errors within an interval that
+	// marks a disk unhealthy, defaults to 1.
+	IOErrorThreshold uint64 `json:"ioErrorThreshold,omitempty"`
+	// RecoveryChecks is the number of consecutive passing checks before an
+	// unhealthy disk is healthy again, defaults to 1.
+	RecoveryChecks int `json:"recoveryChecks,omitempty"`
+}
+
+// Validate checks the spec and fills in the defaults.
+func (s *BlockHealthSpec) Validate() error {
+	if err := validateInterval(&s.Interval, defaultHealthInterval); err != nil {
+		return err
+	}
+	if s.IOErrorThreshold == 0 {
+		s.IOErrorThreshold = 1
+	}
+	if s.RecoveryChecks <= 0 {
+		s.RecoveryChecks = 1
+	}
+	return nil
+}
+
+func (s *BlockHealthSpec) interval() time.Duration {
+	return parseInterval(s.Interval)
+}
+
+// validateInterval fills in the default of a health check interval and checks
+// that it is a positive duration.
+func validateInterval(interval *string, def time.Duration) error {
+	if *interval == "" {
+		*interval = def.String()
+	}
+	if d, err := time.ParseDuration(*interval); err != nil || d <= 0 {
+		return fmt.Errorf("invalid health check interval %q", *interval)
+	}
+	return nil
+}
+
+// parseInterval returns a health check interval checked by validateInterval.
+func parseInterval(interval string) time.Duration {
+	d, _ := time.ParseDuration(interval)
+	return d
+}
+
+// diskHealth is the health of a disk between two checks.
+type diskHealth struct {
+	ioErrors uint64
+	healthy  bool
+	passed   int
+}
+
+// blockHealthChecker checks that a disk still has its device node, that its
+// sysfs state is running and that it has no new I/O errors.
+type blockHealthChecker struct {
+	spec      BlockHealthSpec
+	sysfsRoot string
+	devRoot   string
+	disks     map[string]*diskHealth
+}
+
+func newBlockHealthChecker(spec BlockHealthSpec, sysfsRoot, devRoot string) *blockHealthChecker {
+	return &blockHealthChecker{
+		spec:      spec,
+		sysfsRoot: sysfsRoot,
+		devRoot:   devRoot,
+		disks:     map[string]*diskHealth{},
+	}
+}
+
+// update checks the disk and returns its health, whether it changed since the
+// previous check and the reason of the failure if any.
+func (c *blockHealthChecker) update(name string) (healthy, changed bool, reason string) {
+	h, ok := c.disks[name]
+	if !ok {
+		// the first check sets the I/O errors baseline
+		h = &diskHealth{healthy: true, ioErrors: c.ioErrors(name)}
+		c.disks[name] = h
+	}
+
+	reason = c.check(name, h)
+	switch {
+	case reason != "":
+		h.passed = 0
+		if h.healthy {
+			h.healthy = false
+			return false, true, reason
+		}
+	case !h.healthy:
+		h.passed++
+		if h.passed >= c.spec.RecoveryChecks {
+			h.healthy = true
+			return true, true, ""
+		}
+	}
+	return h.healthy, false, reason
+}
+
+func (c *blockHealthChecker) check(name string, h *diskHealth) string {
+	if _, err := os.Stat(filepath.Join(c.devRoot, name)); err != nil {
+		return fmt.Sprintf("device node: %s", err)
+	}
+	dir := filepath.Join(c.sysfsRoot, "block", name)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Sprintf("sysfs: %s", err)
+	}
+	// scsi disks report "running", nvme controllers "live"
+	if state := readSysfsString(dir, "device/state"); state != "" && state != "running" && state != "live" {
+		return fmt.Sprintf("device state is %s", state)
+	}
+	ioErrors := c.ioErrors(name)
+	newErrors := ioErrors - h.ioErrors
+	if ioErrors < h.ioErrors {
+		// the counter was reset, e.g. the disk was re-attached
+		newErrors = ioErrors
+	}
+	h.ioErrors = ioErrors
+	if newErrors >= c.spec.IOErrorThreshold {
+		return fmt.Sprintf("%d new I/O errors", newErrors)
+	}
+	return ""
+}
+
+// ioErrors reads the hexadecimal ioerr_cnt counter of a scsi disk, 0 if it has none.
+func (c *blockHealthChecker) ioErrors(name string) uint64 {
+	v, _ := strconv.ParseUint(readSysfsString(filepath.Join(c.sysfsRoot, "block", name), "device/ioerr_cnt"), 0, 64)
+	return v
+}
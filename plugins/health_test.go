@@ -0,0 +1,79 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_blockHealthChecker(t *testing.T) {
+	sysfs := newFakeSysfs(t, fakeDisk{name: "sdb", path: "host0/target0:0:1/0:0:1:0", attrs: map[string]string{
+		"device/state":     "running",
+		"device/ioerr_cnt": "0x2",
+	}})
+	dev := t.TempDir()
+	writeFile(t, filepath.Join(dev, "sdb"), "")
+	diskDir := filepath.Join(sysfs, "block", "sdb")
+
+	Convey("Test block health checker", t, func() {
+		spec := BlockHealthSpec{IOErrorThreshold: 3, RecoveryChecks: 2}
+		So(spec.Validate(), ShouldBeNil)
+		c := newBlockHealthChecker(spec, sysfs, dev)
+
+		healthy, changed, _ := c.update("sdb")
+		So(healthy, ShouldBeTrue)
+		So(changed, ShouldBeFalse)
+
+		Convey("io errors", func() {
+			writeFile(t, filepath.Join(diskDir, "device/ioerr_cnt"), "0x4")
+			healthy, changed, _ = c.update("sdb")
+			So(healthy, ShouldBeTrue)
+
+			writeFile(t, filepath.Join(diskDir, "device/ioerr_cnt"), "0x8")
+			healthy, changed, reason := c.update("sdb")
+			So(healthy, ShouldBeFalse)
+			So(changed, ShouldBeTrue)
+			So(reason, ShouldEqual, "4 new I/O errors")
+
+			healthy, changed, _ = c.update("sdb")
+			So(healthy, ShouldBeFalse)
+			So(changed, ShouldBeFalse)
+			healthy, changed, _ = c.update("sdb")
+			So(healthy, ShouldBeTrue)
+			So(changed, ShouldBeTrue)
+		})
+		Convey("state", func() {
+			writeFile(t, filepath.Join(diskDir, "device/state"), "offline")
+			healthy, changed, reason := c.update("sdb")
+			So(healthy, ShouldBeFalse)
+			So(changed, ShouldBeTrue)
+			So(reason, ShouldEqual, "device state is offline")
+			writeFile(t, filepath.Join(diskDir, "device/state"), "running")
+		})
+		Convey("device node removed", func() {
+			So(os.Remove(filepath.Join(dev, "sdb")), ShouldBeNil)
+			healthy, changed, _ := c.update("sdb")
+			So(healthy, ShouldBeFalse)
+			So(changed, ShouldBeTrue)
+			writeFile(t, filepath.Join(dev, "sdb"), "")
+		})
+	})
+}
@@ -0,0 +1,195 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// udevRetryDelay and udevRetries bound the wait for udev: the kernel
+	// uevent of a new disk comes before udev creates its /dev/disk/by-id and
+	// by-path links, which the selectors may match.
+	udevRetryDelay = time.Second
+	udevRetries    = 5
+)
+
+// pendingUevent is an add uevent evaluated again once udev had time to run.
+type pendingUevent struct {
+	event   Uevent
+	attempt int
+}
+
+// watchDevices follows the block uevents to add and remove disks while serving.
+func (m *BlockDevicePlugin) watchDevices(stop <-chan interface{}) {
+	source, err := m.uevents()
+	if err != nil {
+		log.Printf("Could not watch uevents, %s devices will not be hotplugged: %s", m.resourceName, err)
+		return
+	}
+	defer source.Close()
+
+	retries := make(chan pendingUevent)
+	handle := func(p pendingUevent) {
+		m.handleUevent(p.event)
+		if !m.awaitsUdev(p.event) || p.attempt >= udevRetries {
+			return
+		}
+		p.attempt++
+		time.AfterFunc(m.udevRetryDelay, func() {
+			select {
+			case retries <- p:
+			case <-stop:
+			}
+		})
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case e, ok := <-source.Events():
+			if !ok {
+				log.Printf("uevent source of %s closed, stop watching devices", m.resourceName)
+				return
+			}
+			if e.Action == ResyncAction {
+				m.resync()
+				continue
+			}
+			handle(pendingUevent{event: e})
+		case p := <-retries:
+			handle(p)
+		}
+	}
+}
+
+// awaitsUdev tells whether the disk added by e is not served yet, possibly
+// because its udev links are missing.
+func (m *BlockDevicePlugin) awaitsUdev(e Uevent) bool {
+	if e.Subsystem != "block" || e.DevType != "disk" || e.Action != "add" {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, served := m.disks[e.DevName]
+	return !served
+}
+
+// resync rescans the disks after uevents were lost and updates the devices
+// of the class.
+func (m *BlockDevicePlugin) resync() {
+	disks, err := getBlockDevices(m.spec.SysfsRoot, m.spec.ProcRoot, m.spec.DevRoot)
+	if err != nil {
+		log.Printf("Could not rescan %s devices: %s", m.resourceName, err)
+		return
+	}
+	found := map[string]bool{}
+	for _, d := range disks {
+		if m.spec.classify(d) != m.class {
+			m.removeDisk(d.Name, "not selected")
+			continue
+		}
+		found[d.Name] = true
+		m.addDisk(d)
+	}
+	m.mu.RLock()
+	var gone []string
+	for name := range m.disks {
+		if !found[name] {
+			gone = append(gone, name)
+		}
+	}
+	m.mu.RUnlock()
+	for _, name := range gone {
+		m.removeDisk(name, "removed or used by the host")
+	}
+}
+
+// handleUevent updates the devices of the class after a block uevent and
+// tells whether they changed.
+func (m *BlockDevicePlugin) handleUevent(e Uevent) bool {
+	if e.Subsystem != "block" {
+		return false
+	}
+	name := e.DevName
+	if e.DevType == "partition" {
+		// a partition table change may make the disk used or free
+		name = filepath.Base(filepath.Dir(e.DevPath))
+	} else if e.DevType != "disk" {
+		return false
+	}
+
+	if e.Action == "remove" && e.DevType == "disk" {
+		return m.removeDisk(name, "removed")
+	}
+
+	d, err := readBlockDevice(m.spec.SysfsRoot, name)
+	if err != nil {
+		// the disk is already gone
+		return m.removeDisk(name, err.Error())
+	}
+	readDiskLinks(m.spec.DevRoot, []*BlockDevice{d})
+	safety, err := newSafetyAnalyzer(m.spec.SysfsRoot, m.spec.ProcRoot, m.spec.DevRoot)
+	if err != nil {
+		log.Printf("Could not check whether %s is used by the host: %s", name, err)
+		return false
+	}
+	if reason := safety.inUse(d); reason != "" {
+		return m.removeDisk(name, reason)
+	}
+	if m.spec.classify(d) != m.class {
+		return m.removeDisk(name, "not selected")
+	}
+	return m.addDisk(d)
+}
+
+// addDisk adds the disk, or updates the advertised device of a known disk,
+// e.g. its NUMA node, and tells whether the devices changed.
+func (m *BlockDevicePlugin) addDisk(d *BlockDevice) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.disks[d.Name]
+	m.disks[d.Name] = d
+	dev := blockPluginDevice(d)
+	if current, ok := m.registry.get(d.Name); ok {
+		// the health is the one of the health check
+		dev.Health = current.Health
+	}
+	if !m.registry.add(dev) {
+		return false
+	}
+	if exists {
+		log.Printf("%s device %s updated", m.resourceName, d.Name)
+	} else {
+		log.Printf("%s device %s added", m.resourceName, d.Name)
+	}
+	return true
+}
+
+func (m *BlockDevicePlugin) removeDisk(name, reason string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.disks[name]; !exists {
+		return false
+	}
+	delete(m.disks, name)
+	m.registry.remove(name)
+	log.Printf("%s device %s removed: %s", m.resourceName, name, reason)
+	return true
+}
@@ -0,0 +1,207 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeUeventSource delivers synthetic uevents.
+type fakeUeventSource struct {
+	events chan Uevent
+}
+
+func (s *fakeUeventSource) Events() <-chan Uevent { return s.events }
+
+func (s *fakeUeventSource) Close() error { return nil }
+
+func Test_parseUevent(t *testing.T) {
+	Convey("Test parse uevent", t, func() {
+		e, ok := parseUevent([]byte("add@/devices/pci0000:00/0000:00:1f.2/ata2/host1/target1:0:0/1:0:0:0/block/sdb\x00" +
+			"ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:1f.2/ata2/host1/target1:0:0/1:0:0:0/block/sdb\x00" +
+			"SUBSYSTEM=block\x00MAJOR=8\x00MINOR=16\x00DEVNAME=sdb\x00DEVTYPE=disk\x00SEQNUM=4242\x00"))
+		So(ok, ShouldBeTrue)
+		So(e, ShouldResemble, Uevent{
+			Action:    "add",
+			Subsystem: "block",
+			DevType:   "disk",
+			DevName:   "sdb",
+			DevPath:   "/devices/pci0000:00/0000:00:1f.2/ata2/host1/target1:0:0/1:0:0:0/block/sdb",
+		})
+
+		_, ok = parseUevent([]byte("libudev\x00\xfe\xed\xca\xfe"))
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestBlockDevicePlugin_hotplug(t *testing.T) {
+	sysfs := newFakeSysfs(t, fakeDisk{name: "sdb", path: "ata2", attrs: map[string]string{"dev": "8:16"}})
+	proc := newFakeProc(t, "", "")
+
+	spec := BlockSpec{SysfsRoot: sysfs, ProcRoot: proc, DevRoot: t.TempDir(), Selector: BlockSelector{Names: []string{"sd*"}}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := getBlockDevices(spec.SysfsRoot, spec.ProcRoot, spec.DevRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newBlockClassPlugin(spec, 0, disks)
+	source := &fakeUeventSource{events: make(chan Uevent)}
+	m.uevents = func() (UeventSource, error) { return source, nil }
+	sub := m.registry.subscribe()
+	<-sub.updates
+	stop := make(chan interface{})
+	go m.watchDevices(stop)
+	defer close(stop)
+
+	waitChanged := func() {
+		select {
+		case <-sub.updates:
+		case <-time.After(5 * time.Second):
+			t.Fatal("devices not updated")
+		}
+	}
+	ids := func() []string {
+		var ids []string
+		for _, d := range m.devices() {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+
+	Convey("Test block device hotplug", t, func() {
+		So(ids(), ShouldResemble, []string{"sdb"})
+
+		addFakeDisk(t, sysfs, fakeDisk{name: "sdc", path: "ata3", attrs: map[string]string{"dev": "8:32"}})
+		source.events <- Uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "sdc", DevPath: "/devices/ata3/block/sdc"}
+		waitChanged()
+		So(ids(), ShouldResemble, []string{"sdb", "sdc"})
+
+		// not selected
+		addFakeDisk(t, sysfs, fakeDisk{name: "vdb", path: "virtio3", attrs: map[string]string{"dev": "252:16"}})
+		source.events <- Uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "vdb", DevPath: "/devices/virtio3/block/vdb"}
+
+		So(os.Remove(filepath.Join(sysfs, "block", "sdb")), ShouldBeNil)
+		source.events <- Uevent{Action: "remove", Subsystem: "block", DevType: "disk", DevName: "sdb", DevPath: "/devices/ata2/block/sdb"}
+		waitChanged()
+		So(ids(), ShouldResemble, []string{"sdc"})
+	})
+}
+
+func TestBlockDevicePlugin_hotplugLinks(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	proc := newFakeProc(t, "", "")
+	dev := t.TempDir()
+
+	spec := BlockSpec{SysfsRoot: sysfs, ProcRoot: proc, DevRoot: dev, Selector: BlockSelector{ByID: []string{"wwn-*"}}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := newBlockClassPlugin(spec, 0, nil)
+	m.udevRetryDelay = 10 * time.Millisecond
+	source := &fakeUeventSource{events: make(chan Uevent)}
+	m.uevents = func() (UeventSource, error) { return source, nil }
+	sub := m.registry.subscribe()
+	<-sub.updates
+	stop := make(chan interface{})
+	go m.watchDevices(stop)
+	defer close(stop)
+
+	Convey("Test a disk selected by a link created by udev after the uevent", t, func() {
+		addFakeDisk(t, sysfs, fakeDisk{name: "sdb", path: "ata2", attrs: map[string]string{"dev": "8:16"}})
+		source.events <- Uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "sdb", DevPath: "/devices/ata2/block/sdb"}
+		// the add event is handled once the next one is received
+		source.events <- Uevent{Action: "add", Subsystem: "net", DevName: "eth1"}
+		So(m.devices(), ShouldBeEmpty)
+
+		So(os.MkdirAll(filepath.Join(dev, "disk", "by-id"), 0755), ShouldBeNil)
+		So(os.Symlink("../../sdb", filepath.Join(dev, "disk", "by-id", "wwn-0x5000c500a1b2c3d4")), ShouldBeNil)
+		select {
+		case <-sub.updates:
+		case <-time.After(5 * time.Second):
+			t.Fatal("devices not updated")
+		}
+		So(m.devices(), ShouldHaveLength, 1)
+		So(m.devices()[0].ID, ShouldEqual, "sdb")
+	})
+}
+
+func TestBlockDevicePlugin_resync(t *testing.T) {
+	sysfs := newFakeSysfs(t, fakeDisk{name: "sdb", path: "ata2", attrs: map[string]string{"dev": "8:16"}})
+	proc := newFakeProc(t, "", "")
+
+	spec := BlockSpec{SysfsRoot: sysfs, ProcRoot: proc, DevRoot: t.TempDir(), Selector: BlockSelector{Names: []string{"sd*"}}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := getBlockDevices(spec.SysfsRoot, spec.ProcRoot, spec.DevRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newBlockClassPlugin(spec, 0, disks)
+	source := &fakeUeventSource{events: make(chan Uevent)}
+	m.uevents = func() (UeventSource, error) { return source, nil }
+	stop := make(chan interface{})
+	go m.watchDevices(stop)
+	defer close(stop)
+
+	Convey("Test rescan after lost uevents", t, func() {
+		addFakeDisk(t, sysfs, fakeDisk{name: "sdc", path: "ata3", attrs: map[string]string{"dev": "8:32"}})
+		So(os.Remove(filepath.Join(sysfs, "block", "sdb")), ShouldBeNil)
+		source.events <- Uevent{Action: ResyncAction}
+		// the resync is done once the next event is received
+		source.events <- Uevent{Action: "add", Subsystem: "net", DevName: "eth1"}
+
+		So(m.devices(), ShouldHaveLength, 1)
+		So(m.devices()[0].ID, ShouldEqual, "sdc")
+	})
+}
+
+func TestBlockDevicePlugin_hotplugChange(t *testing.T) {
+	sysfs := newFakeSysfs(t, fakeDisk{name: "sdb", path: "ata2", attrs: map[string]string{"dev": "8:16", "device/numa_node": "0\n"}})
+	proc := newFakeProc(t, "", "")
+
+	spec := BlockSpec{SysfsRoot: sysfs, ProcRoot: proc, DevRoot: t.TempDir(), Selector: BlockSelector{Names: []string{"sd*"}}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := getBlockDevices(spec.SysfsRoot, spec.ProcRoot, spec.DevRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newBlockClassPlugin(spec, 0, disks)
+
+	Convey("Test a change uevent updates the advertised device", t, func() {
+		So(m.registry.setHealth("sdb", pluginapi.Unhealthy), ShouldBeTrue)
+		change := Uevent{Action: "change", Subsystem: "block", DevType: "disk", DevName: "sdb", DevPath: "/devices/ata2/block/sdb"}
+		So(m.handleUevent(change), ShouldBeFalse)
+
+		writeFile(t, filepath.Join(sysfs, "devices", "ata2", "block", "sdb", "device", "numa_node"), "1\n")
+		So(m.handleUevent(change), ShouldBeTrue)
+		d, ok := m.registry.get("sdb")
+		So(ok, ShouldBeTrue)
+		So(d.Topology.Nodes[0].ID, ShouldEqual, 1)
+		So(d.Health, ShouldEqual, pluginapi.Unhealthy)
+	})
+}
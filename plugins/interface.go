@@ -16,7 +16,106 @@
 
 package plugins
 
+import (
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
 type DevicePlugin interface {
 	Serve() error
 	Stop() error
+	SetPaths(paths Paths)
+}
+
+// Paths locates the sockets shared with kubelet.
+type Paths struct {
+	// PluginDir is the directory of the device plugin sockets.
+	PluginDir string
+	// KubeletSocket is the kubelet registration socket, usually in PluginDir.
+	KubeletSocket string
+	// PodResourcesSocket is the socket of the kubelet PodResources API.
+	PodResourcesSocket string
+}
+
+// DefaultPaths returns the paths of a kubelet with the default root directory.
+func DefaultPaths() Paths {
+	return Paths{PluginDir: pluginapi.DevicePluginPath, KubeletSocket: pluginapi.KubeletSocket, PodResourcesSocket: DefaultPodResourcesSocket}
+}
+
+// pluginGroup serves several plugins as one, e.g. the classes of a BlockSpec.
+type pluginGroup []DevicePlugin
+
+var _ DevicePlugin = pluginGroup{}
+var _ AllocationObserver = pluginGroup{}
+var _ SocketChecker = pluginGroup{}
+var _ Drainer = pluginGroup{}
+
+func (g pluginGroup) Serve() error {
+	for _, p := range g {
+		if err := p.Serve(); err != nil {
+			g.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+func (g pluginGroup) Stop() error {
+	var err error
+	for _, p := range g {
+		if e := p.Stop(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (g pluginGroup) SetPaths(paths Paths) {
+	for _, p := range g {
+		p.SetPaths(paths)
+	}
+}
+
+func (g pluginGroup) UpdateAllocations(allocations Allocations) {
+	for _, p := range g {
+		if o, ok := p.(AllocationObserver); ok {
+			o.UpdateAllocations(allocations)
+		}
+	}
+}
+
+func (g pluginGroup) Drain() {
+	for _, p := range g {
+		if d, ok := p.(Drainer); ok {
+			d.Drain()
+		}
+	}
+}
+
+func (g pluginGroup) CheckSocket() error {
+	for _, p := range g {
+		if c, ok := p.(SocketChecker); ok {
+			if err := c.CheckSocket(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SocketChecker is implemented by the plugins that can tell whether their
+// socket is still the one they serve on.
+type SocketChecker interface {
+	CheckSocket() error
+}
+
+// Drainer is implemented by the plugins that can report all their devices
+// unhealthy to kubelet before stopping.
+type Drainer interface {
+	Drain()
+}
+
+// Resizer is implemented by the plugins whose number of slots can be changed
+// while serving, without registering again with kubelet.
+type Resizer interface {
+	Resize(slots int) error
 }
@@ -0,0 +1,304 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+// Package kubelettest provides a fake kubelet to test device plugins end to
+// end: it serves the Registration API on a socket in a temporary device plugin
+// directory, dials back the registered plugins and follows their devices.
+package kubelettest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Timeout bounds the waits of the fake kubelet.
+const Timeout = 5 * time.Second
+
+// Kubelet is a fake kubelet serving the device plugin Registration API.
+type Kubelet struct {
+	// Dir is the device plugin directory, where the plugins create their sockets.
+	Dir string
+	// Socket is the registration socket, kubelet.sock in Dir.
+	Socket string
+
+	t      testing.TB
+	server *grpc.Server
+
+	mu       sync.Mutex
+	requests []*pluginapi.RegisterRequest
+	plugins  map[string]*Plugin
+	changed  chan struct{}
+}
+
+// New starts a fake kubelet in a temporary directory, it is stopped at the
+// end of the test.
+func New(t testing.TB) *Kubelet {
+	t.Helper()
+	k := &Kubelet{
+		Dir:     t.TempDir(),
+		t:       t,
+		plugins: map[string]*Plugin{},
+		changed: make(chan struct{}),
+	}
+	k.Socket = filepath.Join(k.Dir, "kubelet.sock")
+	k.start()
+	t.Cleanup(k.stop)
+	return k
+}
+
+func (k *Kubelet) start() {
+	k.t.Helper()
+	l, err := net.Listen("unix", k.Socket)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	k.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.server, &registration{k})
+	go k.server.Serve(l)
+}
+
+func (k *Kubelet) stop() {
+	k.server.Stop()
+	k.mu.Lock()
+	plugins := k.plugins
+	k.plugins = map[string]*Plugin{}
+	k.mu.Unlock()
+	for _, p := range plugins {
+		p.close()
+	}
+}
+
+// Restart stops the fake kubelet, removes the sockets of the device plugin
+// directory as kubelet does, and starts it again with a new socket.
+func (k *Kubelet) Restart() {
+	k.t.Helper()
+	k.stop()
+	entries, err := os.ReadDir(k.Dir)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Type()&os.ModeSocket != 0 {
+			os.Remove(filepath.Join(k.Dir, e.Name()))
+		}
+	}
+	k.start()
+}
+
+// Requests returns the RegisterRequests received so far.
+func (k *Kubelet) Requests() []*pluginapi.RegisterRequest {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]*pluginapi.RegisterRequest(nil), k.requests...)
+}
+
+// WaitForPlugin waits until a plugin registered resourceName and returns it.
+func (k *Kubelet) WaitForPlugin(resourceName string) (*Plugin, error) {
+	deadline := time.After(Timeout)
+	for {
+		k.mu.Lock()
+		p, ok := k.plugins[resourceName]
+		changed := k.changed
+		k.mu.Unlock()
+		if ok {
+			return p, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fmt.Errorf("%s was not registered within %s", resourceName, Timeout)
+		}
+	}
+}
+
+// register connects to a registering plugin like kubelet: it gets its
+// options and starts ListAndWatch.
+func (k *Kubelet) register(req *pluginapi.RegisterRequest) error {
+	if req.Version != pluginapi.Version {
+		return fmt.Errorf("unsupported version %q", req.Version)
+	}
+	k.mu.Lock()
+	k.requests = append(k.requests, req)
+	k.mu.Unlock()
+
+	p, err := dialPlugin(filepath.Join(k.Dir, req.Endpoint), req)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if old, ok := k.plugins[req.ResourceName]; ok {
+		old.close()
+	}
+	k.plugins[req.ResourceName] = p
+	close(k.changed)
+	k.changed = make(chan struct{})
+	return nil
+}
+
+type registration struct {
+	k *Kubelet
+}
+
+func (r *registration) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if err := r.k.register(req); err != nil {
+		return nil, err
+	}
+	return &pluginapi.Empty{}, nil
+}
+
+// Plugin is a device plugin registered with the fake kubelet.
+type Plugin struct {
+	Request *pluginapi.RegisterRequest
+	Options *pluginapi.DevicePluginOptions
+	Client  pluginapi.DevicePluginClient
+
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	devices []*pluginapi.Device
+	updates int
+	changed chan struct{}
+}
+
+func dialPlugin(socket string, req *pluginapi.RegisterRequest) (*Plugin, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %s", socket, err)
+	}
+
+	p := &Plugin{
+		Request: req,
+		Client:  pluginapi.NewDevicePluginClient(conn),
+		conn:    conn,
+		changed: make(chan struct{}),
+	}
+	p.Options, err = p.Client.GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	stream, err := p.Client.ListAndWatch(watchCtx, &pluginapi.Empty{})
+	if err != nil {
+		watchCancel()
+		conn.Close()
+		return nil, err
+	}
+	p.cancel = watchCancel
+	go p.watch(stream)
+	return p, nil
+}
+
+func (p *Plugin) watch(stream pluginapi.DevicePlugin_ListAndWatchClient) {
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.devices = resp.Devices
+		p.updates++
+		close(p.changed)
+		p.changed = make(chan struct{})
+		p.mu.Unlock()
+	}
+}
+
+func (p *Plugin) close() {
+	p.cancel()
+	p.conn.Close()
+}
+
+// Devices returns the last devices sent by ListAndWatch.
+func (p *Plugin) Devices() []*pluginapi.Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.devices
+}
+
+// Updates returns the number of ListAndWatch responses received.
+func (p *Plugin) Updates() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.updates
+}
+
+// WaitForDevices waits until the devices sent by ListAndWatch satisfy cond.
+func (p *Plugin) WaitForDevices(cond func([]*pluginapi.Device) bool) ([]*pluginapi.Device, error) {
+	deadline := time.After(Timeout)
+	for {
+		p.mu.Lock()
+		devices, updates, changed := p.devices, p.updates, p.changed
+		p.mu.Unlock()
+		if updates > 0 && cond(devices) {
+			return devices, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return devices, fmt.Errorf("%s devices did not reach the expected state within %s", p.Request.ResourceName, Timeout)
+		}
+	}
+}
+
+// Allocate allocates devices to a single container, as kubelet does when a
+// container requests them.
+func (p *Plugin) Allocate(ids ...string) (*pluginapi.ContainerAllocateResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	resp, err := p.Client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, fmt.Errorf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	return resp.ContainerResponses[0], nil
+}
+
+// Healthy returns the IDs of the healthy devices.
+func Healthy(devices []*pluginapi.Device) []string {
+	var ids []string
+	for _, d := range devices {
+		if d.Health == pluginapi.Healthy {
+			ids = append(ids, d.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,176 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const metricsNamespace = "node_device_plugin"
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_requests_total",
+		Help:      "Device plugin RPCs served, by resource, method and gRPC code.",
+	}, []string{"resource", "method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of the device plugin RPCs, by resource and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"resource", "method"})
+	registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_total",
+		Help:      "Attempts to register with kubelet, by resource.",
+	}, []string{"resource"})
+	registrationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registration_failures_total",
+		Help:      "Failed attempts to register with kubelet, by resource.",
+	}, []string{"resource"})
+	kubeletRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kubelet_restarts_total",
+		Help:      "Kubelet restarts detected from the re-creation of its socket.",
+	})
+
+	devicesDesc = prometheus.NewDesc(metricsNamespace+"_devices",
+		"Devices advertised to kubelet, by resource and health.", []string{"resource", "health"}, nil)
+	allocatedDesc = prometheus.NewDesc(metricsNamespace+"_allocated_devices",
+		"Advertised devices allocated to containers, by resource.", []string{"resource"}, nil)
+	availableDesc = prometheus.NewDesc(metricsNamespace+"_available_devices",
+		"Healthy advertised devices not allocated to any container, by resource.", []string{"resource"}, nil)
+	deviceAllocationDesc = prometheus.NewDesc(metricsNamespace+"_device_allocation",
+		"Container a device is allocated to, always 1.", []string{"resource", "device", "namespace", "pod", "container"}, nil)
+)
+
+// deviceLister is implemented by the plugins to report their devices in the metrics.
+type deviceLister interface {
+	devices() []*pluginapi.Device
+}
+
+// servingPlugins are the plugins whose gRPC server is started.
+var servingPlugins = struct {
+	sync.Mutex
+	servers map[*pluginServer]bool
+}{servers: map[*pluginServer]bool{}}
+
+func addServingPlugin(m *pluginServer) {
+	servingPlugins.Lock()
+	defer servingPlugins.Unlock()
+	servingPlugins.servers[m] = true
+}
+
+func removeServingPlugin(m *pluginServer) {
+	servingPlugins.Lock()
+	defer servingPlugins.Unlock()
+	delete(servingPlugins.servers, m)
+}
+
+// CountKubeletRestart records a restart of kubelet.
+func CountKubeletRestart() {
+	kubeletRestarts.Inc()
+}
+
+// metricsInterceptor counts and times the RPCs served for resourceName.
+func metricsInterceptor(resourceName string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		method := path.Base(info.FullMethod)
+		rpcDuration.WithLabelValues(resourceName, method).Observe(time.Since(start).Seconds())
+		rpcRequests.WithLabelValues(resourceName, method, status.Code(err).String()).Inc()
+		return resp, err
+	}
+}
+
+// devicesCollector reports the devices of the serving plugins and, when known,
+// their allocations.
+type devicesCollector struct {
+	tracker *PodResourcesTracker
+}
+
+func (c *devicesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+	ch <- allocatedDesc
+	ch <- availableDesc
+	ch <- deviceAllocationDesc
+}
+
+func (c *devicesCollector) Collect(ch chan<- prometheus.Metric) {
+	var allocations Allocations
+	if c.tracker != nil {
+		allocations = c.tracker.Allocations()
+	}
+
+	servingPlugins.Lock()
+	defer servingPlugins.Unlock()
+	for m := range servingPlugins.servers {
+		lister, ok := m.impl.(deviceLister)
+		if !ok {
+			continue
+		}
+		allocated := allocations[m.resourceName]
+		counts := map[string]int{pluginapi.Healthy: 0, pluginapi.Unhealthy: 0}
+		used, available := 0, 0
+		for _, d := range lister.devices() {
+			counts[d.Health]++
+			owner, ok := allocated[d.ID]
+			switch {
+			case ok:
+				used++
+				ch <- prometheus.MustNewConstMetric(deviceAllocationDesc, prometheus.GaugeValue, 1,
+					m.resourceName, d.ID, owner.Namespace, owner.Pod, owner.Container)
+			case d.Health == pluginapi.Healthy:
+				available++
+			}
+		}
+		for health, n := range counts {
+			ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(n), m.resourceName, health)
+		}
+		if c.tracker != nil {
+			ch <- prometheus.MustNewConstMetric(allocatedDesc, prometheus.GaugeValue, float64(used), m.resourceName)
+			ch <- prometheus.MustNewConstMetric(availableDesc, prometheus.GaugeValue, float64(available), m.resourceName)
+		}
+	}
+}
+
+// MetricsHandler serves the Prometheus metrics of the device plugins. The
+// allocations are only reported with a tracker.
+func MetricsHandler(tracker *PodResourcesTracker) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcRequests, rpcDuration, registrations, registrationFailures, kubeletRestarts,
+		&devicesCollector{tracker: tracker},
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
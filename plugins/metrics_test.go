@@ -0,0 +1,89 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+)
+
+func Test_devicesCollector(t *testing.T) {
+	Convey("Test devices metrics", t, func() {
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Resource: Resource{ResourceName: "fuse"}, Slots: 3}})
+		So(err, ShouldBeNil)
+		fuse := p.(*FuseDevicePlugin)
+		ids := getSlotDevices("fuse", 3)
+		addServingPlugin(fuse.pluginServer)
+		defer removeServingPlugin(fuse.pluginServer)
+
+		tracker := NewPodResourcesTracker("", 0)
+		tracker.allocations = Allocations{"hdls.me/fuse": {ids[1].ID: {Namespace: "default", Pod: "app", Container: "main"}}}
+
+		So(testutil.CollectAndCompare(&devicesCollector{tracker: tracker}, strings.NewReader(`
+# HELP node_device_plugin_allocated_devices Advertised devices allocated to containers, by resource.
+# TYPE node_device_plugin_allocated_devices gauge
+node_device_plugin_allocated_devices{resource="hdls.me/fuse"} 1
+# HELP node_device_plugin_available_devices Healthy advertised devices not allocated to any container, by resource.
+# TYPE node_device_plugin_available_devices gauge
+node_device_plugin_available_devices{resource="hdls.me/fuse"} 2
+# HELP node_device_plugin_device_allocation Container a device is allocated to, always 1.
+# TYPE node_device_plugin_device_allocation gauge
+node_device_plugin_device_allocation{container="main",device="`+ids[1].ID+`",namespace="default",pod="app",resource="hdls.me/fuse"} 1
+# HELP node_device_plugin_devices Devices advertised to kubelet, by resource and health.
+# TYPE node_device_plugin_devices gauge
+node_device_plugin_devices{health="Healthy",resource="hdls.me/fuse"} 3
+node_device_plugin_devices{health="Unhealthy",resource="hdls.me/fuse"} 0
+`)), ShouldBeNil)
+
+		Convey("unhealthy and without tracker", func() {
+			fuse.updateHealth(errors.New("missing"))
+			So(testutil.CollectAndCompare(&devicesCollector{}, strings.NewReader(`
+# HELP node_device_plugin_devices Devices advertised to kubelet, by resource and health.
+# TYPE node_device_plugin_devices gauge
+node_device_plugin_devices{health="Healthy",resource="hdls.me/fuse"} 0
+node_device_plugin_devices{health="Unhealthy",resource="hdls.me/fuse"} 3
+`)), ShouldBeNil)
+		})
+	})
+}
+
+func Test_metricsInterceptor(t *testing.T) {
+	Convey("Test RPC metrics", t, func() {
+		interceptor := metricsInterceptor("hdls.me/test")
+		info := &grpc.UnaryServerInfo{FullMethod: "/v1beta1.DevicePlugin/Allocate"}
+		ok := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+		fail := func(context.Context, interface{}) (interface{}, error) { return nil, errors.New("unknown device") }
+
+		// the counters are global, only their increase is ours
+		okCount := testutil.ToFloat64(rpcRequests.WithLabelValues("hdls.me/test", "Allocate", "OK"))
+		failCount := testutil.ToFloat64(rpcRequests.WithLabelValues("hdls.me/test", "Allocate", "Unknown"))
+
+		interceptor(context.Background(), nil, info, ok)
+		interceptor(context.Background(), nil, info, fail)
+		interceptor(context.Background(), nil, info, ok)
+
+		So(testutil.ToFloat64(rpcRequests.WithLabelValues("hdls.me/test", "Allocate", "OK"))-okCount, ShouldEqual, 2)
+		So(testutil.ToFloat64(rpcRequests.WithLabelValues("hdls.me/test", "Allocate", "Unknown"))-failCount, ShouldEqual, 1)
+		So(testutil.CollectAndCount(rpcDuration, "node_device_plugin_rpc_duration_seconds"), ShouldBeGreaterThanOrEqualTo, 1)
+	})
+}
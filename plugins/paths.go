@@ -0,0 +1,138 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultKubeletRootDir is the default --root-dir of kubelet.
+	DefaultKubeletRootDir = "/var/lib/kubelet"
+	// kubeliteArgsFile is the default --kubelet-args-file of kubelite, the
+	// process running kubelet and the other services of microk8s.
+	kubeliteArgsFile = "/var/snap/microk8s/current/args/kubelet"
+)
+
+// KubeletPaths returns the paths of a kubelet whose --root-dir is rootDir.
+func KubeletPaths(rootDir string) Paths {
+	dir := filepath.Join(rootDir, "device-plugins")
+	return Paths{
+		PluginDir:          dir + "/",
+		KubeletSocket:      filepath.Join(dir, "kubelet.sock"),
+		PodResourcesSocket: filepath.Join(rootDir, "pod-resources", "kubelet.sock"),
+	}
+}
+
+// DetectKubeletRootDir looks for a running kubelet in procRoot, e.g. /proc,
+// and returns the --root-dir of its command line, DefaultKubeletRootDir when
+// it has none. The kubelet of microk8s runs in kubelite, which reads its
+// flags from a file through /proc/<pid>/root. It returns false when no kubelet
+// process is visible, which is the case unless the pod shares the host PID
+// namespace.
+func DetectKubeletRootDir(procRoot string) (string, bool) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "cmdline"))
+		if err != nil {
+			// the process exited
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+		switch filepath.Base(args[0]) {
+		case "kubelet":
+			return kubeletRootDir(args[1:]), true
+		case "kubelite":
+			if rootDir, ok := kubeliteRootDir(filepath.Join(procRoot, e.Name()), args[1:]); ok {
+				return rootDir, true
+			}
+		}
+	}
+	return "", false
+}
+
+// kubeletRootDir returns the value of the --root-dir flag in the kubelet args.
+func kubeletRootDir(args []string) string {
+	if rootDir, ok := flagValue(args, "root-dir"); ok {
+		return rootDir
+	}
+	return DefaultKubeletRootDir
+}
+
+// kubeliteRootDir returns the --root-dir of the kubelet args file of the
+// kubelite process in procDir, e.g. /proc/42. It returns false when the file
+// cannot be read, e.g. without the right to look into the process root.
+func kubeliteRootDir(procDir string, args []string) (string, bool) {
+	file, ok := flagValue(args, "kubelet-args-file")
+	if !ok {
+		file = kubeliteArgsFile
+	}
+	data, err := os.ReadFile(filepath.Join(procDir, "root", file))
+	if err != nil {
+		return "", false
+	}
+	// the args reference the snap directories, e.g. ${SNAP_COMMON}/var/lib/kubelet
+	env := map[string]string{}
+	if environ, err := os.ReadFile(filepath.Join(procDir, "environ")); err == nil {
+		for _, kv := range strings.Split(string(environ), "\x00") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				env[k] = v
+			}
+		}
+	}
+	var kubeletArgs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, arg := range strings.Fields(line) {
+			arg = os.Expand(arg, func(k string) string { return env[k] })
+			kubeletArgs = append(kubeletArgs, arg)
+		}
+	}
+	return kubeletRootDir(kubeletArgs), true
+}
+
+// flagValue returns the value of the flag name in args, given as --name=value
+// or --name value. The last occurrence wins, as with the kubelet flags.
+func flagValue(args []string, name string) (string, bool) {
+	value, found := "", false
+	for i, arg := range args {
+		flag, v, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || flag != name {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				continue
+			}
+			v = args[i+1]
+		}
+		value, found = v, true
+	}
+	return value, found
+}
@@ -0,0 +1,85 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDetectKubeletRootDir(t *testing.T) {
+	Convey("Test detect kubelet root dir", t, func() {
+		proc := t.TempDir()
+		process := func(pid string, args ...string) {
+			writeFile(t, filepath.Join(proc, pid, "cmdline"), strings.Join(args, "\x00")+"\x00")
+		}
+		process("1", "/sbin/init")
+		process("42", "/usr/bin/containerd")
+		writeFile(t, filepath.Join(proc, "self", "cmdline"), "kubelet\x00")
+
+		Convey("no kubelet", func() {
+			_, ok := DetectKubeletRootDir(proc)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("default root dir", func() {
+			process("1000", "/usr/bin/kubelet", "--config=/var/lib/kubelet/config.yaml")
+			dir, ok := DetectKubeletRootDir(proc)
+			So(ok, ShouldBeTrue)
+			So(dir, ShouldEqual, DefaultKubeletRootDir)
+		})
+		Convey("root dir flag", func() {
+			process("1000", "/var/lib/k0s/bin/kubelet", "--root-dir=/var/lib/k0s/kubelet", "--v=1")
+			dir, ok := DetectKubeletRootDir(proc)
+			So(ok, ShouldBeTrue)
+			So(dir, ShouldEqual, "/var/lib/k0s/kubelet")
+			So(KubeletPaths(dir), ShouldResemble, Paths{
+				PluginDir:          "/var/lib/k0s/kubelet/device-plugins/",
+				KubeletSocket:      "/var/lib/k0s/kubelet/device-plugins/kubelet.sock",
+				PodResourcesSocket: "/var/lib/k0s/kubelet/pod-resources/kubelet.sock",
+			})
+		})
+		Convey("root dir flag with a separate value", func() {
+			process("1000", "kubelet", "--v", "2", "-root-dir", "/data/kubelet")
+			dir, ok := DetectKubeletRootDir(proc)
+			So(ok, ShouldBeTrue)
+			So(dir, ShouldEqual, "/data/kubelet")
+		})
+		Convey("microk8s kubelite", func() {
+			process("1000", "/snap/microk8s/6089/kubelite", "--scheduler-args-file=/var/snap/microk8s/6089/args/kube-scheduler")
+			writeFile(t, filepath.Join(proc, "1000", "environ"), "SNAP=/snap/microk8s/6089\x00SNAP_COMMON=/var/snap/microk8s/common\x00")
+			writeFile(t, filepath.Join(proc, "1000", "root", "var/snap/microk8s/current/args/kubelet"),
+				"--kubeconfig=${SNAP_DATA}/credentials/kubelet.config\n# the kubelet state\n--root-dir=${SNAP_COMMON}/var/lib/kubelet\n")
+			dir, ok := DetectKubeletRootDir(proc)
+			So(ok, ShouldBeTrue)
+			So(dir, ShouldEqual, "/var/snap/microk8s/common/var/lib/kubelet")
+		})
+		Convey("kubelite args file not readable", func() {
+			process("1000", "/snap/microk8s/6089/kubelite", "--kubelet-args-file", "/var/snap/microk8s/6089/args/kubelet")
+			_, ok := DetectKubeletRootDir(proc)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestKubeletPaths(t *testing.T) {
+	Convey("Test default kubelet paths", t, func() {
+		So(KubeletPaths(DefaultKubeletRootDir), ShouldResemble, DefaultPaths())
+	})
+}
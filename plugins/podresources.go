@@ -0,0 +1,210 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	// DefaultPodResourcesSocket is the socket of the kubelet PodResources API.
+	DefaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	// DefaultPodResourcesInterval is the period between two ListPodResources calls.
+	DefaultPodResourcesInterval = 10 * time.Second
+	podResourcesTimeout         = 5 * time.Second
+)
+
+// DeviceOwner is the container a device is allocated to.
+type DeviceOwner struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+}
+
+// Allocations maps resource names to their allocated device IDs and owners.
+type Allocations map[string]map[string]DeviceOwner
+
+// AllocationObserver is implemented by the plugins that follow which of their
+// devices are allocated, e.g. to release the fuse slots removed by a resize.
+type AllocationObserver interface {
+	UpdateAllocations(allocations Allocations)
+}
+
+// PodResourcesTracker periodically lists the devices allocated to the pods
+// with the kubelet PodResources API and keeps the ones of our resources.
+type PodResourcesTracker struct {
+	socket   string
+	interval time.Duration
+
+	mu          sync.RWMutex
+	resources   map[string]bool
+	allocations Allocations
+	// listed is set once the pod resources were listed
+	listed bool
+	// failing is set while kubelet cannot be reached, to only log the first failure
+	failing bool
+
+	updates chan struct{}
+}
+
+func NewPodResourcesTracker(socket string, interval time.Duration) *PodResourcesTracker {
+	return &PodResourcesTracker{
+		socket:      socket,
+		interval:    interval,
+		resources:   map[string]bool{},
+		allocations: Allocations{},
+		updates:     make(chan struct{}, 1),
+	}
+}
+
+// SetResources sets the resource names to track.
+func (t *PodResourcesTracker) SetResources(names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resources = map[string]bool{}
+	for _, name := range names {
+		t.resources[name] = true
+	}
+}
+
+// Run updates the allocations every interval until stop is closed.
+func (t *PodResourcesTracker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Update(); err != nil {
+			t.mu.Lock()
+			if !t.failing {
+				log.Printf("Could not list the pod resources from %s: %s", t.socket, err)
+			}
+			t.failing = true
+			t.mu.Unlock()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update lists the pod resources once and notifies Updates when the
+// allocations changed.
+func (t *PodResourcesTracker) Update() error {
+	// fail fast instead of waiting for the dial timeout when kubelet is not there
+	if _, err := os.Stat(t.socket); err != nil {
+		return err
+	}
+	conn, err := dial(t.socket, podResourcesTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	allocations := Allocations{}
+	for _, pod := range resp.PodResources {
+		for _, c := range pod.Containers {
+			for _, d := range c.Devices {
+				if !t.resources[d.ResourceName] {
+					continue
+				}
+				if allocations[d.ResourceName] == nil {
+					allocations[d.ResourceName] = map[string]DeviceOwner{}
+				}
+				for _, id := range d.DeviceIds {
+					allocations[d.ResourceName][id] = DeviceOwner{Namespace: pod.Namespace, Pod: pod.Name, Container: c.Name}
+				}
+			}
+		}
+	}
+	if t.failing {
+		log.Printf("Listing the pod resources from %s again", t.socket)
+		t.failing = false
+	}
+	changed := !t.listed || !allocations.equal(t.allocations)
+	t.allocations = allocations
+	t.listed = true
+	t.mu.Unlock()
+
+	if changed {
+		select {
+		case t.updates <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Updates is notified when the allocations change.
+func (t *PodResourcesTracker) Updates() <-chan struct{} {
+	return t.updates
+}
+
+// Listed tells whether the pod resources were listed at least once, the
+// allocations are unknown before that.
+func (t *PodResourcesTracker) Listed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.listed
+}
+
+// Allocations returns a copy of the current allocations.
+func (t *PodResourcesTracker) Allocations() Allocations {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	allocations := Allocations{}
+	for resource, devices := range t.allocations {
+		allocations[resource] = map[string]DeviceOwner{}
+		for id, owner := range devices {
+			allocations[resource][id] = owner
+		}
+	}
+	return allocations
+}
+
+func (a Allocations) equal(b Allocations) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for resource, devices := range a {
+		other, ok := b[resource]
+		if !ok || len(devices) != len(other) {
+			return false
+		}
+		for id, owner := range devices {
+			if o, ok := other[id]; !ok || o != owner {
+				return false
+			}
+		}
+	}
+	return true
+}
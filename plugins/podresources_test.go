@@ -0,0 +1,155 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakePodResources is a kubelet PodResources server returning pods.
+type fakePodResources struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	mu   sync.Mutex
+	pods []*podresourcesapi.PodResources
+}
+
+func (f *fakePodResources) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+func (f *fakePodResources) setPods(pods ...*podresourcesapi.PodResources) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pods = pods
+}
+
+// serveFakePodResources serves f on a unix socket and returns its path.
+func serveFakePodResources(t *testing.T, f *fakePodResources) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, f)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return socket
+}
+
+func podWithDevices(namespace, name, container, resource string, ids ...string) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{
+		Namespace: namespace,
+		Name:      name,
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    container,
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: resource, DeviceIds: ids}},
+		}},
+	}
+}
+
+func TestPodResourcesTracker(t *testing.T) {
+	fake := &fakePodResources{}
+	socket := serveFakePodResources(t, fake)
+
+	Convey("Test PodResources tracker", t, func() {
+		fake.setPods(
+			podWithDevices("default", "fuse-pod", "app", "hdls.me/fuse", "fuse-node-0", "fuse-node-3"),
+			podWithDevices("db", "postgres-0", "postgres", "hdls.me/sdx", "sdb"),
+			podWithDevices("default", "gpu-pod", "cuda", "nvidia.com/gpu", "GPU-1234"),
+		)
+		tracker := NewPodResourcesTracker(socket, time.Hour)
+		tracker.SetResources([]string{"hdls.me/fuse", "hdls.me/sdx"})
+		So(tracker.Listed(), ShouldBeFalse)
+
+		So(tracker.Update(), ShouldBeNil)
+		So(tracker.Listed(), ShouldBeTrue)
+		So(tracker.Allocations(), ShouldResemble, Allocations{
+			"hdls.me/fuse": {
+				"fuse-node-0": {Namespace: "default", Pod: "fuse-pod", Container: "app"},
+				"fuse-node-3": {Namespace: "default", Pod: "fuse-pod", Container: "app"},
+			},
+			"hdls.me/sdx": {"sdb": {Namespace: "db", Pod: "postgres-0", Container: "postgres"}},
+		})
+		So(tracker.Updates(), ShouldHaveLength, 1)
+		<-tracker.Updates()
+
+		Convey("unchanged", func() {
+			So(tracker.Update(), ShouldBeNil)
+			So(tracker.Updates(), ShouldHaveLength, 0)
+		})
+
+		Convey("released", func() {
+			fake.setPods(podWithDevices("db", "postgres-0", "postgres", "hdls.me/sdx", "sdb"))
+			So(tracker.Update(), ShouldBeNil)
+			So(tracker.Updates(), ShouldHaveLength, 1)
+			So(tracker.Allocations(), ShouldResemble, Allocations{
+				"hdls.me/sdx": {"sdb": {Namespace: "db", Pod: "postgres-0", Container: "postgres"}},
+			})
+		})
+
+		Convey("copies", func() {
+			a := tracker.Allocations()
+			delete(a["hdls.me/sdx"], "sdb")
+			So(tracker.Allocations()["hdls.me/sdx"], ShouldHaveLength, 1)
+		})
+
+		Convey("runs until stopped", func() {
+			fake.setPods()
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				tracker.Run(stop)
+				close(done)
+			}()
+			select {
+			case <-tracker.Updates():
+			case <-time.After(5 * time.Second):
+				t.Fatal("no update")
+			}
+			So(tracker.Allocations(), ShouldBeEmpty)
+			close(stop)
+			<-done
+		})
+	})
+
+	Convey("Test PodResources tracker without kubelet", t, func() {
+		tracker := NewPodResourcesTracker(filepath.Join(t.TempDir(), "missing.sock"), time.Hour)
+		So(tracker.Update(), ShouldNotBeNil)
+		So(tracker.Listed(), ShouldBeFalse)
+	})
+
+	Convey("Test PodResources tracker first listing nothing", t, func() {
+		fake.setPods()
+		tracker := NewPodResourcesTracker(socket, time.Hour)
+		So(tracker.Update(), ShouldBeNil)
+		// the allocations are known now, even if empty
+		So(tracker.Updates(), ShouldHaveLength, 1)
+	})
+}
@@ -0,0 +1,353 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The pre-start actions prepare a disk before the container using it starts.
+const (
+	// VerifyUnusedAction fails when the disk got mounted, used as swap or
+	// claimed by another device (LVM, md RAID, dm-crypt...) since discovery.
+	VerifyUnusedAction = "verify-unused"
+	// WipeAction zeroes the first and last MiB of the disk, erasing the
+	// partition tables and the filesystem and RAID signatures. The disk is
+	// verified unused first, and only wiped once per allocation.
+	WipeAction = "wipe"
+	// DiscardAction discards all the blocks of the disk. The disk is verified
+	// unused first, and only discarded once per allocation.
+	DiscardAction = "discard"
+	// OwnerAction sets the owner and the mode of the device nodes.
+	OwnerAction = "owner"
+)
+
+const (
+	defaultPreStartTimeout = 30 * time.Second
+	// wipeSize is the size zeroed at both ends of a disk, it covers the MBR,
+	// both GPT headers and the superblocks of the usual filesystems.
+	wipeSize = 1 << 20
+	// blkDiscard is the BLKDISCARD ioctl, _IO(0x12, 119)
+	blkDiscard = 0x1277
+)
+
+// PreStartSpec configures the actions run by PreStartContainer.
+type PreStartSpec struct {
+	// Actions run in order on every disk allocated to the container.
+	Actions []PreStartAction `json:"actions,omitempty"`
+	// Timeout of all the actions of a container, defaults to 30s.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// PreStartAction is one step of the preparation of a disk.
+type PreStartAction struct {
+	// Type is verify-unused, wipe, discard or owner.
+	Type string `json:"type"`
+	// UID, GID and Mode (octal, e.g. "0660") of the owner action.
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// Validate checks the spec and fills in the defaults.
+func (s *PreStartSpec) Validate() error {
+	if len(s.Actions) == 0 {
+		return nil
+	}
+	if s.Timeout == "" {
+		s.Timeout = defaultPreStartTimeout.String()
+	}
+	if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid pre-start timeout %q", s.Timeout)
+	}
+	for _, a := range s.Actions {
+		switch a.Type {
+		case VerifyUnusedAction, WipeAction, DiscardAction:
+		case OwnerAction:
+			if a.UID == nil && a.GID == nil && a.Mode == "" {
+				return fmt.Errorf("pre-start action %s needs a uid, gid or mode", a.Type)
+			}
+			if _, err := a.mode(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown pre-start action %q, expected one of %s, %s, %s or %s",
+				a.Type, VerifyUnusedAction, WipeAction, DiscardAction, OwnerAction)
+		}
+	}
+	return nil
+}
+
+func (s *PreStartSpec) timeout() time.Duration {
+	d, _ := time.ParseDuration(s.Timeout)
+	return d
+}
+
+func (a *PreStartAction) mode() (os.FileMode, error) {
+	if a.Mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(a.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", a.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// busyDisks are the device nodes with pre-start actions still running, maybe
+// left behind by a timeout. A new pre-start on them fails until they return,
+// so that a retry by kubelet never races with a wipe or a discard.
+var busyDisks = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// acquireDisks marks the paths busy, it fails if any of them already is.
+func acquireDisks(paths []string) error {
+	busyDisks.Lock()
+	defer busyDisks.Unlock()
+	for _, p := range paths {
+		if busyDisks.paths[p] {
+			return fmt.Errorf("pre-start actions on %s from a previous attempt are still running", p)
+		}
+	}
+	for _, p := range paths {
+		busyDisks.paths[p] = true
+	}
+	return nil
+}
+
+func releaseDisks(paths []string) {
+	busyDisks.Lock()
+	defer busyDisks.Unlock()
+	for _, p := range paths {
+		delete(busyDisks.paths, p)
+	}
+}
+
+// preStartRunner runs the pre-start actions on the disks of a container.
+type preStartRunner struct {
+	spec       PreStartSpec
+	sysfsRoot  string
+	procRoot   string
+	devRoot    string
+	partitions bool
+	// fresh are the disks allocated and not prepared yet, the only ones
+	// wiped or discarded: a restarted container, or an app container reusing
+	// the disk of an init container, keeps its data.
+	fresh map[string]bool
+}
+
+// run runs the actions on every disk in order, it stops at the first failure
+// or when the timeout expires. The disks stay busy until the actions really
+// return.
+func (r *preStartRunner) run(disks []string) error {
+	var paths []string
+	for _, disk := range disks {
+		paths = append(paths, filepath.Join(r.devRoot, disk))
+	}
+	if err := acquireDisks(paths); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.spec.timeout())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer releaseDisks(paths)
+		for _, disk := range disks {
+			for _, a := range r.spec.Actions {
+				if ctx.Err() != nil {
+					done <- ctx.Err()
+					return
+				}
+				if err := r.runAction(a, disk); err != nil {
+					done <- fmt.Errorf("%s %s: %s", a.Type, disk, err)
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// an action blocked in the kernel cannot be interrupted, it is left
+		// behind and keeps the disks busy
+		return fmt.Errorf("pre-start actions on %v did not complete within %s", disks, r.spec.Timeout)
+	}
+}
+
+func (r *preStartRunner) runAction(a PreStartAction, disk string) error {
+	path := filepath.Join(r.devRoot, disk)
+	switch a.Type {
+	case VerifyUnusedAction:
+		return r.verifyUnused(disk)
+	case WipeAction:
+		if !r.fresh[disk] {
+			return nil
+		}
+		// destructive actions never trust the order of the actions
+		if err := r.verifyUnused(disk); err != nil {
+			return err
+		}
+		// the partitions first, their signatures are not at the ends of the disk
+		parts, err := getPartitions(r.sysfsRoot, disk)
+		if err != nil {
+			return err
+		}
+		for _, p := range parts {
+			if err := wipeDevice(filepath.Join(r.devRoot, p)); err != nil {
+				return err
+			}
+		}
+		return wipeDevice(path)
+	case DiscardAction:
+		if !r.fresh[disk] {
+			return nil
+		}
+		if err := r.verifyUnused(disk); err != nil {
+			return err
+		}
+		return discardDevice(path)
+	case OwnerAction:
+		paths := []string{path}
+		if r.partitions {
+			parts, err := getPartitions(r.sysfsRoot, disk)
+			if err != nil {
+				return err
+			}
+			for _, p := range parts {
+				paths = append(paths, filepath.Join(r.devRoot, p))
+			}
+		}
+		for _, p := range paths {
+			if err := setOwner(p, a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyUnused checks the disk again with fresh mounts and holders, and that
+// the kernel lets us open it exclusively, which fails when anything claims it.
+func (r *preStartRunner) verifyUnused(disk string) error {
+	d, err := readBlockDevice(r.sysfsRoot, disk)
+	if err != nil {
+		return err
+	}
+	safety, err := newSafetyAnalyzer(r.sysfsRoot, r.procRoot, r.devRoot)
+	if err != nil {
+		return err
+	}
+	if reason := safety.inUse(d); reason != "" {
+		return errors.New(reason)
+	}
+	f, err := os.OpenFile(filepath.Join(r.devRoot, disk), os.O_RDONLY|unix.O_EXCL, 0)
+	if err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return fmt.Errorf("disk %s is claimed by the kernel", disk)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// wipeDevice zeroes the first and the last wipeSize bytes of the device.
+func wipeDevice(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// seeking to the end gives the size of block devices as well as files
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, wipeSize)
+	offsets := []int64{0}
+	if size > wipeSize {
+		offsets = append(offsets, size-wipeSize)
+	}
+	for _, off := range offsets {
+		n := int64(wipeSize)
+		if off+n > size {
+			n = size - off
+		}
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// discardDevice discards all the blocks of a block device with BLKDISCARD.
+func discardDevice(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	r := [2]uint64{0, uint64(size)}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), blkDiscard, uintptr(unsafe.Pointer(&r[0]))); errno != 0 {
+		return os.NewSyscallError("BLKDISCARD", errno)
+	}
+	return nil
+}
+
+// setOwner applies the uid, gid and mode of an owner action to path.
+func setOwner(path string, a PreStartAction) error {
+	if a.UID != nil || a.GID != nil {
+		uid, gid := -1, -1
+		if a.UID != nil {
+			uid = *a.UID
+		}
+		if a.GID != nil {
+			gid = *a.GID
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if a.Mode != "" {
+		mode, _ := a.mode()
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
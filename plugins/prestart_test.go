@@ -0,0 +1,244 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/sys/unix"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPreStartSpec_Validate(t *testing.T) {
+	uid := 1000
+	tests := []struct {
+		name  string
+		spec  PreStartSpec
+		valid bool
+	}{
+		{name: "empty", spec: PreStartSpec{}, valid: true},
+		{name: "actions", spec: PreStartSpec{Actions: []PreStartAction{{Type: VerifyUnusedAction}, {Type: WipeAction}, {Type: OwnerAction, UID: &uid, Mode: "0660"}}}, valid: true},
+		{name: "unknown action", spec: PreStartSpec{Actions: []PreStartAction{{Type: "format"}}}},
+		{name: "owner without owner", spec: PreStartSpec{Actions: []PreStartAction{{Type: OwnerAction}}}},
+		{name: "invalid mode", spec: PreStartSpec{Actions: []PreStartAction{{Type: OwnerAction, Mode: "rw"}}}},
+		{name: "invalid timeout", spec: PreStartSpec{Actions: []PreStartAction{{Type: WipeAction}}, Timeout: "-1s"}},
+	}
+
+	Convey("Test PreStartSpec validation", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				err := tt.spec.Validate()
+				if tt.valid {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldNotBeNil)
+				}
+			})
+		}
+		Convey("default timeout", func() {
+			spec := PreStartSpec{Actions: []PreStartAction{{Type: WipeAction}}}
+			So(spec.Validate(), ShouldBeNil)
+			So(spec.timeout(), ShouldEqual, defaultPreStartTimeout)
+		})
+	})
+}
+
+func Test_preStartRunner(t *testing.T) {
+	sysfs := newFakeSysfs(t,
+		fakeDisk{name: "sdb", path: "ata2", attrs: map[string]string{"dev": "8:16"}, parts: map[string]map[string]string{
+			"sdb1": {"dev": "8:17"},
+		}},
+		fakeDisk{name: "sdc", path: "ata3", attrs: map[string]string{"dev": "8:32"}},
+		fakeDisk{name: "sdd", path: "ata4", attrs: map[string]string{"dev": "8:48"}},
+	)
+	proc := newFakeProc(t, "22 1 8:32 / /data rw,relatime shared:1 - ext4 /dev/sdc rw\n", "Filename Type Size Used Priority\n")
+
+	dev := t.TempDir()
+	ones := bytes.Repeat([]byte{0xff}, 3*wipeSize)
+	for _, name := range []string{"sdb", "sdb1", "sdc"} {
+		writeFile(t, filepath.Join(dev, name), string(ones))
+	}
+	runner := func(actions ...PreStartAction) *preStartRunner {
+		spec := PreStartSpec{Actions: actions}
+		if err := spec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		fresh := map[string]bool{"sdb": true, "sdc": true, "sdd": true}
+		return &preStartRunner{spec: spec, sysfsRoot: sysfs, procRoot: proc, devRoot: dev, partitions: true, fresh: fresh}
+	}
+
+	Convey("Test pre-start actions", t, func() {
+		Convey("verify unused", func() {
+			So(runner(PreStartAction{Type: VerifyUnusedAction}).run([]string{"sdb"}), ShouldBeNil)
+			err := runner(PreStartAction{Type: VerifyUnusedAction}).run([]string{"sdb", "sdc"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "disk sdc is mounted on /data")
+		})
+
+		Convey("wipe", func() {
+			So(runner(PreStartAction{Type: WipeAction}).run([]string{"sdb"}), ShouldBeNil)
+			for _, name := range []string{"sdb", "sdb1"} {
+				data, err := os.ReadFile(filepath.Join(dev, name))
+				So(err, ShouldBeNil)
+				So(data, ShouldHaveLength, 3*wipeSize)
+				zeros := make([]byte, wipeSize)
+				So(bytes.Equal(data[:wipeSize], zeros), ShouldBeTrue)
+				So(bytes.Equal(data[wipeSize:2*wipeSize], ones[:wipeSize]), ShouldBeTrue)
+				So(bytes.Equal(data[2*wipeSize:], zeros), ShouldBeTrue)
+			}
+		})
+
+		Convey("wipe and discard skip the prepared disks", func() {
+			writeFile(t, filepath.Join(dev, "sdb"), string(ones))
+			r := runner(PreStartAction{Type: WipeAction}, PreStartAction{Type: DiscardAction})
+			r.fresh = nil
+			So(r.run([]string{"sdb"}), ShouldBeNil)
+			data, err := os.ReadFile(filepath.Join(dev, "sdb"))
+			So(err, ShouldBeNil)
+			So(bytes.Equal(data, ones), ShouldBeTrue)
+		})
+
+		Convey("wipe verifies the disk is unused", func() {
+			err := runner(PreStartAction{Type: WipeAction}).run([]string{"sdc"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "disk sdc is mounted on /data")
+			data, err := os.ReadFile(filepath.Join(dev, "sdc"))
+			So(err, ShouldBeNil)
+			So(bytes.Equal(data, ones), ShouldBeTrue)
+		})
+
+		Convey("owner", func() {
+			uid, gid := os.Getuid(), os.Getgid()
+			So(runner(PreStartAction{Type: OwnerAction, UID: &uid, GID: &gid, Mode: "0640"}).run([]string{"sdb"}), ShouldBeNil)
+			for _, name := range []string{"sdb", "sdb1"} {
+				fi, err := os.Stat(filepath.Join(dev, name))
+				So(err, ShouldBeNil)
+				So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0640))
+			}
+		})
+
+		Convey("discard fails on a regular file", func() {
+			err := runner(PreStartAction{Type: DiscardAction}).run([]string{"sdb"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "discard sdb:")
+		})
+
+		Convey("actions run in order and stop at the first failure", func() {
+			err := runner(PreStartAction{Type: VerifyUnusedAction}, PreStartAction{Type: OwnerAction, Mode: "0600"}).run([]string{"sdc"})
+			So(err, ShouldNotBeNil)
+			fi, err := os.Stat(filepath.Join(dev, "sdc"))
+			So(err, ShouldBeNil)
+			So(fi.Mode().Perm(), ShouldNotEqual, os.FileMode(0600))
+		})
+
+		Convey("timeout", func() {
+			r := runner(PreStartAction{Type: VerifyUnusedAction})
+			r.spec.Timeout = "1ns"
+			So(r.run([]string{"sdb"}), ShouldNotBeNil)
+		})
+
+		Convey("a disk stays busy until the actions left behind return", func() {
+			// opening a fifo blocks until it has a writer, like a stuck device
+			fifo := filepath.Join(dev, "sdd")
+			So(unix.Mkfifo(fifo, 0600), ShouldBeNil)
+			defer os.Remove(fifo)
+			r := runner(PreStartAction{Type: WipeAction})
+			r.spec.Timeout = "50ms"
+			err := r.run([]string{"sdd"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "did not complete")
+
+			err = r.run([]string{"sdb", "sdd"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "still running")
+
+			// unblock the action left behind, it then fails on the fifo
+			w, err := os.OpenFile(fifo, os.O_RDWR, 0)
+			So(err, ShouldBeNil)
+			defer w.Close()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				err = acquireDisks([]string{fifo})
+				if err == nil || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(err, ShouldBeNil)
+			releaseDisks([]string{fifo})
+		})
+	})
+}
+
+func TestBlockDevicePlugin_PreStartContainer(t *testing.T) {
+	sysfs := newFakeSysfs(t, fakeDisk{name: "sdb", path: "ata2", attrs: map[string]string{"dev": "8:16"}})
+	proc := newFakeProc(t, "", "")
+	dev := t.TempDir()
+	ones := bytes.Repeat([]byte{0xff}, 3*wipeSize)
+	writeFile(t, filepath.Join(dev, "sdb"), string(ones))
+
+	spec := BlockSpec{
+		SysfsRoot: sysfs, ProcRoot: proc, DevRoot: dev,
+		Selector: BlockSelector{Names: []string{"sd*"}},
+		PreStart: PreStartSpec{Actions: []PreStartAction{{Type: WipeAction}}},
+	}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := getBlockDevices(spec.SysfsRoot, spec.ProcRoot, spec.DevRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newBlockClassPlugin(spec, 0, disks)
+	allocate := func() {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"sdb"}}},
+		})
+		So(err, ShouldBeNil)
+	}
+	preStart := func() {
+		_, err := m.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{"sdb"}})
+		So(err, ShouldBeNil)
+	}
+	wiped := func() bool {
+		data, err := os.ReadFile(filepath.Join(dev, "sdb"))
+		So(err, ShouldBeNil)
+		return bytes.Equal(data[:wipeSize], make([]byte, wipeSize))
+	}
+
+	Convey("Test disks are wiped once per allocation", t, func() {
+		allocate()
+		preStart()
+		So(wiped(), ShouldBeTrue)
+
+		// the workload writes its data, then its container restarts
+		writeFile(t, filepath.Join(dev, "sdb"), string(ones))
+		preStart()
+		So(wiped(), ShouldBeFalse)
+
+		// a new pod gets the disk
+		allocate()
+		preStart()
+		So(wiped(), ShouldBeTrue)
+	})
+}
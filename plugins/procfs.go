@@ -0,0 +1,146 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultProcRoot = "/proc"
+
+// initPIDNamespace is the link of the initial pid namespace, PROC_PID_INIT_INO.
+const initPIDNamespace = "pid:[4026531836]"
+
+// selfProcRoot is the /proc of the plugin process, compared with procRoot.
+var selfProcRoot = "/proc"
+
+// mountTable lists the devices mounted in the mount namespace of pid 1.
+type mountTable struct {
+	// byDev maps the "major:minor" numbers of the mounted devices to one of
+	// their mount points.
+	byDev map[string]string
+	// bySource maps the names of the mounted devices, e.g. sda2, to one of
+	// their mount points. btrfs and other file systems report an anonymous
+	// 0:NN device, only their source tells which disk they are on.
+	bySource map[string]string
+}
+
+// mountedDevices returns the devices mounted in the mount namespace of pid 1.
+// When the host /proc is mounted at procRoot, these are the host mounts. The
+// mount sources are resolved in devRoot, e.g. /dev/disk/by-uuid links.
+func mountedDevices(procRoot, devRoot string) (*mountTable, error) {
+	if err := checkHostProc(procRoot, selfProcRoot); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(procRoot, "1", "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := &mountTable{byDev: map[string]string{}, bySource: map[string]string{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if _, ok := mounts.byDev[fields[2]]; !ok {
+			mounts.byDev[fields[2]] = fields[4]
+		}
+		// the optional fields end with a "-", followed by the type and the source
+		for i := 6; i+2 < len(fields); i++ {
+			if fields[i] != "-" {
+				continue
+			}
+			if name := sourceDevice(devRoot, fields[i+2]); name != "" {
+				if _, ok := mounts.bySource[name]; !ok {
+					mounts.bySource[name] = fields[4]
+				}
+			}
+			break
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// sourceDevice returns the name of the device of a mount source like
+// /dev/sda2 or /dev/disk/by-uuid/..., "" if it is not a device.
+func sourceDevice(devRoot, source string) string {
+	if !strings.HasPrefix(source, "/dev/") {
+		return ""
+	}
+	path := filepath.Join(devRoot, strings.TrimPrefix(source, "/dev/"))
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return filepath.Base(path)
+}
+
+// checkHostProc fails when procRoot does not show the host processes, e.g.
+// the /proc of a pod without hostPID: its pid 1 is then in the mount namespace
+// of the plugin, so the host mounts cannot be seen and every disk would look
+// unused. Running in the host namespaces, outside of a container, is fine.
+func checkHostProc(procRoot, selfRoot string) error {
+	initNS, err := os.Readlink(filepath.Join(procRoot, "1", "ns", "mnt"))
+	if errors.Is(err, os.ErrPermission) {
+		// only a more privileged process than the plugin, like the host init, is unreadable
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot tell whether %s is the host /proc: %s", procRoot, err)
+	}
+	self, err := os.Readlink(filepath.Join(selfRoot, "self", "ns", "mnt"))
+	if err != nil {
+		return fmt.Errorf("cannot tell whether %s is the host /proc: %s", procRoot, err)
+	}
+	if initNS != self {
+		return nil
+	}
+	if pid, err := os.Readlink(filepath.Join(selfRoot, "self", "ns", "pid")); err == nil && pid == initPIDNamespace {
+		return nil
+	}
+	return fmt.Errorf("%s does not show the host processes, the host mounts cannot be checked: run with hostPID or mount the host /proc and set procRoot", procRoot)
+}
+
+// swapDevices returns the names of the block devices used as swap in <procRoot>/swaps.
+func swapDevices(procRoot string) (map[string]bool, error) {
+	f, err := os.Open(filepath.Join(procRoot, "swaps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	swaps := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Filename  Type  Size  Used  Priority
+		// /dev/sda2 partition 8388604 0 -2
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1] != "partition" {
+			continue
+		}
+		swaps[filepath.Base(fields[0])] = true
+	}
+	return swaps, scanner.Err()
+}
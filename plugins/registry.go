@@ -0,0 +1,202 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceSnapshot is the state of a deviceRegistry at a version.
+type deviceSnapshot struct {
+	version uint64
+	devices []*pluginapi.Device
+}
+
+// deviceRegistry holds the devices advertised by a plugin. It is shared by the
+// ListAndWatch streams, Allocate and the health checkers and watchers that
+// update it. Every change makes a new version, delivered to all the
+// subscriptions.
+type deviceRegistry struct {
+	mu sync.RWMutex
+	// devices by ID, order keeps the IDs in the order they were added
+	devices map[string]*pluginapi.Device
+	order   []string
+	version uint64
+	subs    map[*deviceSubscription]bool
+}
+
+// deviceSubscription receives the snapshots of a registry, starting with the
+// current one. A subscriber that falls behind skips to the latest snapshot.
+type deviceSubscription struct {
+	updates chan deviceSnapshot
+}
+
+func newDeviceRegistry(devs []*pluginapi.Device) *deviceRegistry {
+	r := &deviceRegistry{
+		devices: map[string]*pluginapi.Device{},
+		subs:    map[*deviceSubscription]bool{},
+	}
+	r.set(devs)
+	return r
+}
+
+// snapshot returns a copy of the devices and their version.
+func (r *deviceRegistry) snapshot() deviceSnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotLocked()
+}
+
+func (r *deviceRegistry) snapshotLocked() deviceSnapshot {
+	devs := make([]*pluginapi.Device, 0, len(r.order))
+	for _, id := range r.order {
+		devs = append(devs, copyDevice(r.devices[id]))
+	}
+	return deviceSnapshot{version: r.version, devices: devs}
+}
+
+// get returns a copy of the device with the given ID.
+func (r *deviceRegistry) get(id string) (*pluginapi.Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.devices[id]
+	if !ok {
+		return nil, false
+	}
+	return copyDevice(d), true
+}
+
+// set replaces all the devices and returns whether they changed.
+func (r *deviceRegistry) set(devs []*pluginapi.Device) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := len(devs) != len(r.order)
+	for i := 0; !changed && i < len(devs); i++ {
+		current := r.devices[r.order[i]]
+		changed = devs[i].ID != current.ID || !sameDevice(devs[i], current)
+	}
+	if !changed {
+		return false
+	}
+	r.devices = map[string]*pluginapi.Device{}
+	r.order = nil
+	for _, d := range devs {
+		if _, exists := r.devices[d.ID]; !exists {
+			r.order = append(r.order, d.ID)
+		}
+		r.devices[d.ID] = copyDevice(d)
+	}
+	r.publishLocked()
+	return true
+}
+
+// add adds or replaces a device and returns whether it changed.
+func (r *deviceRegistry) add(d *pluginapi.Device) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, exists := r.devices[d.ID]
+	if exists && sameDevice(d, current) {
+		return false
+	}
+	if !exists {
+		r.order = append(r.order, d.ID)
+	}
+	r.devices[d.ID] = copyDevice(d)
+	r.publishLocked()
+	return true
+}
+
+// remove removes a device and returns whether it existed.
+func (r *deviceRegistry) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.devices[id]; !exists {
+		return false
+	}
+	delete(r.devices, id)
+	for i, o := range r.order {
+		if o == id {
+			r.order = append(r.order[:i:i], r.order[i+1:]...)
+			break
+		}
+	}
+	r.publishLocked()
+	return true
+}
+
+// setHealth sets the health of a device and returns whether it changed.
+func (r *deviceRegistry) setHealth(id, health string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, exists := r.devices[id]
+	if !exists || d.Health == health {
+		return false
+	}
+	d.Health = health
+	r.publishLocked()
+	return true
+}
+
+// subscribe returns a subscription receiving the current snapshot and the
+// following ones until unsubscribe.
+func (r *deviceRegistry) subscribe() *deviceSubscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub := &deviceSubscription{updates: make(chan deviceSnapshot, 1)}
+	sub.updates <- r.snapshotLocked()
+	r.subs[sub] = true
+	return sub
+}
+
+func (r *deviceRegistry) unsubscribe(sub *deviceSubscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subs, sub)
+}
+
+// publishLocked makes a new version and hands it to every subscription,
+// replacing the snapshot they did not receive yet. r.mu must be held.
+func (r *deviceRegistry) publishLocked() {
+	r.version++
+	snap := r.snapshotLocked()
+	for sub := range r.subs {
+		select {
+		case <-sub.updates:
+		default:
+		}
+		// only publishLocked sends, under r.mu, so there is room now
+		sub.updates <- snap
+	}
+}
+
+func sameDevice(a, b *pluginapi.Device) bool {
+	return a.Health == b.Health && a.Topology.String() == b.Topology.String()
+}
+
+func copyDevice(d *pluginapi.Device) *pluginapi.Device {
+	c := &pluginapi.Device{ID: d.ID, Health: d.Health}
+	if d.Topology != nil {
+		c.Topology = &pluginapi.TopologyInfo{}
+		for _, n := range d.Topology.Nodes {
+			c.Topology.Nodes = append(c.Topology.Nodes, &pluginapi.NUMANode{ID: n.ID})
+		}
+	}
+	return c
+}
@@ -0,0 +1,153 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceRegistry(t *testing.T) {
+	Convey("Test device registry", t, func() {
+		r := newDeviceRegistry([]*pluginapi.Device{
+			{ID: "b", Health: pluginapi.Healthy},
+			{ID: "a", Health: pluginapi.Healthy, Topology: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 1}}}},
+		})
+		ids := func() []string {
+			var ids []string
+			for _, d := range r.snapshot().devices {
+				ids = append(ids, d.ID)
+			}
+			return ids
+		}
+		So(ids(), ShouldResemble, []string{"b", "a"})
+		So(r.snapshot().version, ShouldEqual, 1)
+
+		Convey("snapshots are copies", func() {
+			snap := r.snapshot()
+			snap.devices[0].Health = pluginapi.Unhealthy
+			snap.devices[1].Topology.Nodes[0].ID = 0
+			d, ok := r.get("a")
+			So(ok, ShouldBeTrue)
+			So(d.Topology.Nodes[0].ID, ShouldEqual, 1)
+			d, _ = r.get("b")
+			So(d.Health, ShouldEqual, pluginapi.Healthy)
+		})
+
+		Convey("only changes make a new version", func() {
+			So(r.setHealth("a", pluginapi.Healthy), ShouldBeFalse)
+			So(r.setHealth("z", pluginapi.Unhealthy), ShouldBeFalse)
+			So(r.add(&pluginapi.Device{ID: "b", Health: pluginapi.Healthy}), ShouldBeFalse)
+			So(r.remove("z"), ShouldBeFalse)
+			So(r.set(r.snapshot().devices), ShouldBeFalse)
+			So(r.snapshot().version, ShouldEqual, 1)
+
+			So(r.setHealth("a", pluginapi.Unhealthy), ShouldBeTrue)
+			So(r.add(&pluginapi.Device{ID: "c", Health: pluginapi.Healthy}), ShouldBeTrue)
+			So(r.remove("b"), ShouldBeTrue)
+			So(ids(), ShouldResemble, []string{"a", "c"})
+			So(r.snapshot().version, ShouldEqual, 4)
+
+			So(r.set([]*pluginapi.Device{{ID: "c", Health: pluginapi.Healthy}}), ShouldBeTrue)
+			So(ids(), ShouldResemble, []string{"c"})
+			So(r.snapshot().version, ShouldEqual, 5)
+		})
+
+		Convey("subscriptions start with the current snapshot and skip to the latest", func() {
+			sub := r.subscribe()
+			So((<-sub.updates).version, ShouldEqual, 1)
+
+			r.setHealth("a", pluginapi.Unhealthy)
+			r.setHealth("b", pluginapi.Unhealthy)
+			snap := <-sub.updates
+			So(snap.version, ShouldEqual, 3)
+			So(snap.devices[0].Health, ShouldEqual, pluginapi.Unhealthy)
+			So(sub.updates, ShouldHaveLength, 0)
+
+			r.unsubscribe(sub)
+			r.setHealth("a", pluginapi.Healthy)
+			So(sub.updates, ShouldHaveLength, 0)
+		})
+	})
+}
+
+func TestDeviceRegistry_concurrent(t *testing.T) {
+	Convey("Test device registry with concurrent writers and subscribers", t, func() {
+		const writers, updates, subscribers = 4, 100, 3
+		var devs []*pluginapi.Device
+		for i := 0; i < writers; i++ {
+			devs = append(devs, &pluginapi.Device{ID: fmt.Sprint(i), Health: pluginapi.Healthy})
+		}
+		r := newDeviceRegistry(devs)
+		// every writer toggles the health of its device, then adds one
+		final := uint64(1 + writers*(updates+1))
+
+		var subscribed, readers sync.WaitGroup
+		last := make([]deviceSnapshot, subscribers)
+		for i := 0; i < subscribers; i++ {
+			subscribed.Add(1)
+			readers.Add(1)
+			go func(i int) {
+				defer readers.Done()
+				sub := r.subscribe()
+				defer r.unsubscribe(sub)
+				subscribed.Done()
+				for snap := range sub.updates {
+					if snap.version < last[i].version {
+						t.Errorf("version went back from %d to %d", last[i].version, snap.version)
+					}
+					last[i] = snap
+					if snap.version == final {
+						return
+					}
+				}
+			}(i)
+		}
+		subscribed.Wait()
+
+		var writing sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			writing.Add(1)
+			go func(id string) {
+				defer writing.Done()
+				for j := 0; j < updates; j++ {
+					health := pluginapi.Unhealthy
+					if j%2 == 1 {
+						health = pluginapi.Healthy
+					}
+					r.setHealth(id, health)
+					// readers race with the writers
+					r.snapshot()
+					r.get(id)
+				}
+				r.add(&pluginapi.Device{ID: id + "-new", Health: pluginapi.Healthy})
+			}(fmt.Sprint(i))
+		}
+		writing.Wait()
+		readers.Wait()
+
+		So(r.snapshot().version, ShouldEqual, final)
+		for i := 0; i < subscribers; i++ {
+			So(last[i].version, ShouldEqual, final)
+			So(last[i].devices, ShouldHaveLength, 2*writers)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultResourceDomain is the domain of resource names given without one.
+const DefaultResourceDomain = "hdls.me"
+
+var (
+	// dns1123SubdomainRegexp and qualifiedNameRegexp follow k8s.io/apimachinery/pkg/util/validation.
+	dns1123SubdomainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	qualifiedNameRegexp    = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]$`)
+)
+
+// Resource is the extended resource advertised by a plugin.
+type Resource struct {
+	// ResourceDomain qualifies ResourceName when it has no domain, defaults to DefaultResourceDomain.
+	ResourceDomain string `json:"resourceDomain,omitempty"`
+	// ResourceName is either a bare name such as "fuse" or a full name such as "example.com/fuse".
+	ResourceName string `json:"resourceName,omitempty"`
+}
+
+// validate qualifies the resource name, falling back to defaultName, and checks
+// it against the Kubernetes extended resource naming rules.
+func (r *Resource) validate(defaultName string) error {
+	if r.ResourceDomain == "" {
+		r.ResourceDomain = DefaultResourceDomain
+	}
+	if r.ResourceName == "" {
+		r.ResourceName = defaultName
+	}
+	if r.ResourceName == "" {
+		return fmt.Errorf("resource name is required")
+	}
+	if !strings.Contains(r.ResourceName, "/") {
+		r.ResourceName = r.ResourceDomain + "/" + r.ResourceName
+	}
+	return ValidateResourceName(r.ResourceName)
+}
+
+// ValidateResourceName checks that name is a valid extended resource name, the
+// same way kubelet does when a device plugin registers.
+func ValidateResourceName(name string) error {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid resource name %q: must be <domain>/<name>", name)
+	}
+	domain, short := parts[0], parts[1]
+	if domain == "kubernetes.io" || strings.HasSuffix(domain, ".kubernetes.io") {
+		return fmt.Errorf("invalid resource name %q: domain %s is reserved for native resources", name, domain)
+	}
+	// kubelet also validates the quota name "requests.<name>"
+	if len("requests."+domain) > 253 || !dns1123SubdomainRegexp.MatchString(domain) {
+		return fmt.Errorf("invalid resource name %q: domain must be a lowercase DNS subdomain", name)
+	}
+	if strings.HasPrefix(domain, "requests.") {
+		return fmt.Errorf("invalid resource name %q: must not start with \"requests.\"", name)
+	}
+	if len(short) > 63 || !qualifiedNameRegexp.MatchString(short) {
+		return fmt.Errorf("invalid resource name %q: name must be at most 63 alphanumeric characters, '-', '_' or '.'", name)
+	}
+	return nil
+}
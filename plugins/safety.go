@@ -0,0 +1,90 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// safetyAnalyzer tells whether a disk is used by the host, so that it is never
+// handed to a pod: a mounted disk or partition, an active swap, or a disk or
+// partition held by LVM, md RAID, dm-crypt or any other stacked device.
+type safetyAnalyzer struct {
+	sysfsRoot string
+	mounts    *mountTable
+	swaps     map[string]bool
+}
+
+func newSafetyAnalyzer(sysfsRoot, procRoot, devRoot string) (*safetyAnalyzer, error) {
+	mounts, err := mountedDevices(procRoot, devRoot)
+	if err != nil {
+		return nil, err
+	}
+	swaps, err := swapDevices(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &safetyAnalyzer{sysfsRoot: sysfsRoot, mounts: mounts, swaps: swaps}, nil
+}
+
+// inUse returns why the disk is used by the host, or "" if it is free.
+func (a *safetyAnalyzer) inUse(d *BlockDevice) string {
+	if reason := a.check("disk "+d.Name, d.Name, d.Dev, d.Holders); reason != "" {
+		return reason
+	}
+	for _, p := range d.Partitions {
+		if reason := a.check("partition "+p.Name, p.Name, p.Dev, p.Holders); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+func (a *safetyAnalyzer) check(what, name, dev string, holders []string) string {
+	if mountPoint, ok := a.mounts.byDev[dev]; ok {
+		return fmt.Sprintf("%s is mounted on %s", what, mountPoint)
+	}
+	if mountPoint, ok := a.mounts.bySource[name]; ok {
+		return fmt.Sprintf("%s is mounted on %s", what, mountPoint)
+	}
+	if a.swaps[name] {
+		return fmt.Sprintf("%s is an active swap", what)
+	}
+	if len(holders) > 0 {
+		return fmt.Sprintf("%s is %s", what, a.describeHolder(holders[0]))
+	}
+	return ""
+}
+
+// describeHolder tells what kind of stacked device holds a disk.
+func (a *safetyAnalyzer) describeHolder(holder string) string {
+	if strings.HasPrefix(holder, "md") {
+		return fmt.Sprintf("a member of md RAID %s", holder)
+	}
+	uuid := readSysfsString(filepath.Join(a.sysfsRoot, "block", holder), "dm/uuid")
+	switch {
+	case strings.HasPrefix(uuid, "LVM-"):
+		return fmt.Sprintf("an LVM physical volume of %s", holder)
+	case strings.HasPrefix(uuid, "CRYPT-"):
+		return fmt.Sprintf("encrypted by dm-crypt %s", holder)
+	case strings.HasPrefix(uuid, "mpath-"):
+		return fmt.Sprintf("a path of multipath %s", holder)
+	}
+	return fmt.Sprintf("held by %s", holder)
+}
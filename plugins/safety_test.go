@@ -0,0 +1,148 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_safetyAnalyzer(t *testing.T) {
+	part := func(dev string) map[string]string { return map[string]string{"dev": dev} }
+	sysfs := newFakeSysfs(t,
+		// OS disk, partitions mounted
+		fakeDisk{name: "sda", path: "ata1", attrs: part("8:0"), parts: map[string]map[string]string{
+			"sda1": part("8:1"), "sda2": part("8:2"),
+		}},
+		// swap partition
+		fakeDisk{name: "sdb", path: "ata2", attrs: part("8:16"), parts: map[string]map[string]string{
+			"sdb1": part("8:17"),
+		}},
+		// whole disk LVM physical volume
+		fakeDisk{name: "sdc", path: "ata3", attrs: map[string]string{"dev": "8:32", "holders/dm-0/dev": "253:0"}},
+		// md RAID member partition
+		fakeDisk{name: "sdd", path: "ata4", attrs: part("8:48"), parts: map[string]map[string]string{
+			"sdd1": {"dev": "8:49", "holders/md0/dev": "9:0"},
+		}},
+		// free disk with an unused partition table
+		fakeDisk{name: "sde", path: "ata5", attrs: part("8:64"), parts: map[string]map[string]string{
+			"sde1": part("8:65"),
+		}},
+		// mounted whole disk
+		fakeDisk{name: "nvme0n1", path: "nvme0", attrs: part("259:0")},
+		// btrfs partition, mounted with an anonymous device number
+		fakeDisk{name: "sdf", path: "ata6", attrs: part("8:80"), parts: map[string]map[string]string{
+			"sdf1": part("8:81"),
+		}},
+		// btrfs whole disk mounted by UUID
+		fakeDisk{name: "sdg", path: "ata7", attrs: part("8:96")},
+		fakeDisk{name: "dm-0", path: "virtual", attrs: map[string]string{"dev": "253:0", "dm/uuid": "LVM-abcdef"}},
+	)
+	proc := newFakeProc(t, `22 1 8:2 / / rw,relatime shared:1 - ext4 /dev/sda2 rw
+23 22 8:1 / /boot rw,relatime shared:2 - vfat /dev/sda1 rw
+24 22 259:0 / /var/lib/docker rw,relatime shared:3 - xfs /dev/nvme0n1 rw
+25 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+26 22 0:45 /@data /data rw,relatime shared:4 - btrfs /dev/sdf1 rw,ssd,space_cache=v2,subvolid=257,subvol=/@data
+27 22 0:46 / /backup rw,relatime shared:5 master:1 - btrfs /dev/disk/by-uuid/0b5e rw,space_cache=v2
+`, `Filename				Type		Size		Used		Priority
+/dev/sdb1                               partition	8388604		0		-2
+/swapfile                               file		1048572		0		-3
+`)
+	dev := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dev, "disk", "by-uuid"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../sdg", filepath.Join(dev, "disk", "by-uuid", "0b5e")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dev, "sdg"), "")
+
+	Convey("Test safety analyzer", t, func() {
+		a, err := newSafetyAnalyzer(sysfs, proc, dev)
+		So(err, ShouldBeNil)
+		disks, err := discoverBlockDevices(sysfs)
+		So(err, ShouldBeNil)
+
+		reasons := map[string]string{}
+		for _, d := range disks {
+			reasons[d.Name] = a.inUse(d)
+		}
+		So(reasons, ShouldResemble, map[string]string{
+			"sda":     "partition sda1 is mounted on /boot",
+			"sdb":     "partition sdb1 is an active swap",
+			"sdc":     "disk sdc is an LVM physical volume of dm-0",
+			"sdd":     "partition sdd1 is a member of md RAID md0",
+			"sde":     "",
+			"nvme0n1": "disk nvme0n1 is mounted on /var/lib/docker",
+			"sdf":     "partition sdf1 is mounted on /data",
+			"sdg":     "disk sdg is mounted on /backup",
+		})
+	})
+}
+
+func Test_checkHostProc(t *testing.T) {
+	// fakeProc links the mount and pid namespaces of pid 1 and of the plugin
+	fakeProc := func(initNS, self, selfPID string) (string, string) {
+		proc, selfRoot := t.TempDir(), t.TempDir()
+		for _, l := range []struct{ path, target string }{
+			{filepath.Join(proc, "1", "ns", "mnt"), initNS},
+			{filepath.Join(selfRoot, "self", "ns", "mnt"), self},
+			{filepath.Join(selfRoot, "self", "ns", "pid"), selfPID},
+		} {
+			if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(l.target, l.path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return proc, selfRoot
+	}
+
+	Convey("Test host /proc check", t, func() {
+		Convey("host pid namespace", func() {
+			So(checkHostProc(fakeProc("mnt:[4026531840]", "mnt:[4026532001]", "pid:[4026532002]")), ShouldBeNil)
+		})
+		Convey("outside of a container", func() {
+			So(checkHostProc(fakeProc("mnt:[4026531840]", "mnt:[4026531840]", initPIDNamespace)), ShouldBeNil)
+		})
+		Convey("pod without hostPID", func() {
+			So(checkHostProc(fakeProc("mnt:[4026532001]", "mnt:[4026532001]", "pid:[4026532002]")), ShouldNotBeNil)
+		})
+		Convey("not a procfs", func() {
+			So(checkHostProc(t.TempDir(), "/proc"), ShouldNotBeNil)
+		})
+	})
+}
+
+// newFakeProc returns a /proc with the given host mountinfo and swaps, whose
+// pid 1 is in another mount namespace than the tests.
+func newFakeProc(t *testing.T, mountinfo, swaps string) string {
+	proc := t.TempDir()
+	writeFile(t, filepath.Join(proc, "1", "mountinfo"), mountinfo)
+	writeFile(t, filepath.Join(proc, "swaps"), swaps)
+	if err := os.MkdirAll(filepath.Join(proc, "1", "ns"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("mnt:[1]", filepath.Join(proc, "1", "ns", "mnt")); err != nil {
+		t.Fatal(err)
+	}
+	return proc
+}
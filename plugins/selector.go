@@ -0,0 +1,181 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BlockSelector selects disks by their sysfs attributes. Every field that is
+// set must match; list fields match if any of their entries does.
+type BlockSelector struct {
+	// Names are glob patterns of the disk names, e.g. "nvme*".
+	Names []string `json:"names,omitempty"`
+	// NameRegex is a regular expression of the disk names. When neither Names
+	// nor NameRegex is set, the default device regex applies.
+	NameRegex string `json:"nameRegex,omitempty"`
+	// MinSize and MaxSize bound the disk size, e.g. "100Gi" or "2T".
+	MinSize string `json:"minSize,omitempty"`
+	MaxSize string `json:"maxSize,omitempty"`
+	// Models and Vendors are glob patterns.
+	Models  []string `json:"models,omitempty"`
+	Vendors []string `json:"vendors,omitempty"`
+	// Serials is an allowlist of serial numbers.
+	Serials    []string `json:"serials,omitempty"`
+	Rotational *bool    `json:"rotational,omitempty"`
+	Removable  *bool    `json:"removable,omitempty"`
+	// ByID and ByPath are glob patterns of the /dev/disk/by-id and
+	// /dev/disk/by-path link names of the disk.
+	ByID   []string `json:"byId,omitempty"`
+	ByPath []string `json:"byPath,omitempty"`
+
+	// nameRegex is NameRegex compiled by Validate
+	nameRegex *regexp.Regexp
+}
+
+// Validate checks the patterns and sizes of the selector.
+func (s *BlockSelector) Validate() error {
+	if s.NameRegex != "" {
+		re, err := regexp.Compile(s.NameRegex)
+		if err != nil {
+			return fmt.Errorf("invalid name regex %q: %s", s.NameRegex, err)
+		}
+		s.nameRegex = re
+	}
+	for _, patterns := range [][]string{s.Names, s.Models, s.Vendors, s.ByID, s.ByPath} {
+		for _, p := range patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %s", p, err)
+			}
+		}
+	}
+	for _, size := range []string{s.MinSize, s.MaxSize} {
+		if size == "" {
+			continue
+		}
+		if _, err := parseSize(size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches tells whether the disk is selected. A NameRegex selects nothing
+// until the selector is validated.
+func (s *BlockSelector) Matches(d *BlockDevice) bool {
+	if len(s.Names) > 0 && !matchAny(s.Names, d.Name) {
+		return false
+	}
+	if s.NameRegex != "" && (s.nameRegex == nil || !s.nameRegex.MatchString(d.Name)) {
+		return false
+	}
+	if s.MinSize != "" {
+		if min, _ := parseSize(s.MinSize); d.Size < min {
+			return false
+		}
+	}
+	if s.MaxSize != "" {
+		if max, _ := parseSize(s.MaxSize); d.Size > max {
+			return false
+		}
+	}
+	if len(s.Models) > 0 && !matchAny(s.Models, d.Model) {
+		return false
+	}
+	if len(s.Vendors) > 0 && !matchAny(s.Vendors, d.Vendor) {
+		return false
+	}
+	if len(s.Serials) > 0 && !containsString(s.Serials, d.Serial) {
+		return false
+	}
+	if s.Rotational != nil && *s.Rotational != d.Rotational {
+		return false
+	}
+	if s.Removable != nil && *s.Removable != d.Removable {
+		return false
+	}
+	if len(s.ByID) > 0 && !matchAnyOf(s.ByID, d.ByID) {
+		return false
+	}
+	if len(s.ByPath) > 0 && !matchAnyOf(s.ByPath, d.ByPath) {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyOf(patterns []string, names []string) bool {
+	for _, name := range names {
+		if matchAny(patterns, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var sizeSuffixes = map[string]uint64{
+	"":   1,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+}
+
+// parseSize parses a size in bytes with an optional Kubernetes quantity
+// suffix, decimal (k, M, G, T, P) or binary (Ki, Mi, Gi, Ti, Pi).
+func parseSize(size string) (uint64, error) {
+	i := strings.IndexFunc(size, func(r rune) bool { return r < '0' || r > '9' })
+	if i == -1 {
+		i = len(size)
+	}
+	multiplier, ok := sizeSuffixes[size[i:]]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	v, err := strconv.ParseUint(size[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %s", size, err)
+	}
+	return v * multiplier, nil
+}
@@ -0,0 +1,94 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBlockSelector(t *testing.T) {
+	yes, no := true, false
+	osDisk := &BlockDevice{Name: "sda", Size: 240e9, Model: "INTEL SSDSC2KB24", Vendor: "ATA", Serial: "BTYF0001", ByPath: []string{"pci-0000:00:1f.2-ata-1"}}
+	nvme := &BlockDevice{Name: "nvme0n1", Size: 3840e9, Model: "SAMSUNG MZQL23T8", Serial: "S64H0002", ByID: []string{"nvme-SAMSUNG_MZQL23T8_S64H0002", "nvme-eui.0025"}}
+	hdd := &BlockDevice{Name: "sdb", Size: 8e12, Rotational: true, Model: "ST8000NM000A", Vendor: "SEAGATE", Serial: "ZA0003"}
+	usb := &BlockDevice{Name: "sdc", Size: 32e9, Removable: true, Model: "Ultra Fit", Vendor: "SanDisk"}
+
+	tests := []struct {
+		name     string
+		selector BlockSelector
+		want     []*BlockDevice
+	}{
+		{name: "everything", selector: BlockSelector{}, want: []*BlockDevice{osDisk, nvme, hdd, usb}},
+		{name: "name glob", selector: BlockSelector{Names: []string{"nvme*"}}, want: []*BlockDevice{nvme}},
+		{name: "name regex", selector: BlockSelector{NameRegex: `^sd[bc]$`}, want: []*BlockDevice{hdd, usb}},
+		{name: "min size", selector: BlockSelector{MinSize: "1Ti"}, want: []*BlockDevice{nvme, hdd}},
+		{name: "size range", selector: BlockSelector{MinSize: "100G", MaxSize: "4T"}, want: []*BlockDevice{osDisk, nvme}},
+		{name: "model", selector: BlockSelector{Models: []string{"SAMSUNG *", "INTEL *"}}, want: []*BlockDevice{osDisk, nvme}},
+		{name: "vendor", selector: BlockSelector{Vendors: []string{"SEAGATE"}}, want: []*BlockDevice{hdd}},
+		{name: "serial", selector: BlockSelector{Serials: []string{"S64H0002", "ZA0003"}}, want: []*BlockDevice{nvme, hdd}},
+		{name: "rotational", selector: BlockSelector{Rotational: &yes}, want: []*BlockDevice{hdd}},
+		{name: "ssd", selector: BlockSelector{Rotational: &no, Removable: &no}, want: []*BlockDevice{osDisk, nvme}},
+		{name: "removable", selector: BlockSelector{Removable: &yes}, want: []*BlockDevice{usb}},
+		{name: "by-id", selector: BlockSelector{ByID: []string{"nvme-SAMSUNG_*"}}, want: []*BlockDevice{nvme}},
+		{name: "by-path", selector: BlockSelector{ByPath: []string{"pci-*-ata-*"}}, want: []*BlockDevice{osDisk}},
+	}
+
+	Convey("Test block selector", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				So(tt.selector.Validate(), ShouldBeNil)
+				var got []*BlockDevice
+				for _, d := range []*BlockDevice{osDisk, nvme, hdd, usb} {
+					if tt.selector.Matches(d) {
+						got = append(got, d)
+					}
+				}
+				So(got, ShouldResemble, tt.want)
+			})
+		}
+		Convey("invalid", func() {
+			So((&BlockSelector{MinSize: "1TB"}).Validate(), ShouldNotBeNil)
+			So((&BlockSelector{NameRegex: "("}).Validate(), ShouldNotBeNil)
+			So((&BlockSelector{Names: []string{"["}}).Validate(), ShouldNotBeNil)
+		})
+		Convey("not validated", func() {
+			So((&BlockSelector{NameRegex: "("}).Matches(hdd), ShouldBeFalse)
+			So((&BlockSpec{}).classify(hdd), ShouldEqual, -1)
+		})
+		Convey("classes", func() {
+			spec := BlockSpec{
+				Resource:   Resource{ResourceDomain: "example.com"},
+				SocketName: "disks.sock",
+				Classes: []BlockClass{
+					{Resource: Resource{ResourceName: "os"}, Selector: BlockSelector{Serials: []string{"BTYF0001"}}},
+					{Resource: Resource{ResourceName: "nvme"}, Selector: BlockSelector{Names: []string{"nvme*"}}},
+					{Resource: Resource{ResourceName: "hdd"}, Selector: BlockSelector{Rotational: &yes}},
+					{Resource: Resource{ResourceName: "ssd"}, Selector: BlockSelector{Rotational: &no, Removable: &no}},
+				},
+			}
+			So(spec.Validate(), ShouldBeNil)
+			So(spec.Classes[1].ResourceName, ShouldEqual, "example.com/nvme")
+			So(spec.Classes[1].SocketName, ShouldEqual, "disks-nvme.sock")
+			So(spec.classify(osDisk), ShouldEqual, 0)
+			So(spec.classify(nvme), ShouldEqual, 1)
+			So(spec.classify(hdd), ShouldEqual, 2)
+			So(spec.classify(usb), ShouldEqual, -1)
+		})
+	})
+}
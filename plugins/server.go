@@ -0,0 +1,312 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// defaultStopTimeout is how long Stop waits for the in-flight calls, e.g. an
+// Allocate or a PreStartContainer wiping disks, before aborting them.
+const defaultStopTimeout = 10 * time.Second
+
+// healthChecker is implemented by plugins that monitor their devices while
+// serving, until stop is closed.
+type healthChecker interface {
+	healthcheck(stop <-chan interface{})
+}
+
+// deviceWatcher is implemented by plugins whose devices come and go while
+// serving, until stop is closed.
+type deviceWatcher interface {
+	watchDevices(stop <-chan interface{})
+}
+
+// pluginServer owns the unix socket, the gRPC server and the kubelet registration
+// shared by every device plugin. Plugins embed it and only implement the
+// device specific parts of pluginapi.DevicePluginServer.
+type pluginServer struct {
+	resourceName string
+	// socket is the path of the socket named socketName in the plugin directory
+	socketName    string
+	socket        string
+	kubeletSocket string
+	impl          pluginapi.DevicePluginServer
+	stopTimeout   time.Duration
+
+	// runMu protects the state of the current run below, from Start to Stop
+	runMu sync.Mutex
+	// stop is closed by Stop, drain by Drain, both are made again by Start
+	stop     chan interface{}
+	drain    chan interface{}
+	draining bool
+
+	server *grpc.Server
+	// socketFile is the socket created by Start, to notice when it is removed or replaced
+	socketFile os.FileInfo
+}
+
+func newPluginServer(resourceName, socketName string, impl pluginapi.DevicePluginServer) *pluginServer {
+	m := &pluginServer{
+		resourceName: resourceName,
+		socketName:   socketName,
+		impl:         impl,
+		stopTimeout:  defaultStopTimeout,
+	}
+	m.SetPaths(DefaultPaths())
+	return m
+}
+
+// SetPaths sets where the plugin creates its socket and registers, it must be
+// called before Serve.
+func (m *pluginServer) SetPaths(paths Paths) {
+	m.socket = filepath.Join(paths.PluginDir, m.socketName)
+	m.kubeletSocket = paths.KubeletSocket
+}
+
+// Start starts the gRPC server of the device plugin, stopping the previous
+// run if any.
+func (m *pluginServer) Start() error {
+	if err := m.Stop(); err != nil {
+		return err
+	}
+	if err := m.cleanup(); err != nil {
+		return err
+	}
+
+	sock, err := net.Listen("unix", m.socket)
+	if err != nil {
+		return err
+	}
+	socketFile, err := os.Stat(m.socket)
+	if err != nil {
+		sock.Close()
+		return err
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(metricsInterceptor(m.resourceName)))
+	pluginapi.RegisterDevicePluginServer(server, m.impl)
+
+	stop := make(chan interface{})
+	m.runMu.Lock()
+	m.server = server
+	m.socketFile = socketFile
+	m.stop = stop
+	m.drain = make(chan interface{})
+	m.draining = false
+	m.runMu.Unlock()
+
+	go server.Serve(sock)
+
+	// Wait for server to start by launching a blocking connexion
+	conn, err := dial(m.socket, 5*time.Second)
+	if err != nil {
+		m.Stop()
+		return err
+	}
+	conn.Close()
+	addServingPlugin(m)
+
+	if h, ok := m.impl.(healthChecker); ok {
+		go h.healthcheck(stop)
+	}
+	if w, ok := m.impl.(deviceWatcher); ok {
+		go w.watchDevices(stop)
+	}
+
+	return nil
+}
+
+// Stop stops the gRPC server, waiting up to stopTimeout for the in-flight
+// calls. It can be called several times.
+func (m *pluginServer) Stop() error {
+	m.runMu.Lock()
+	server, stop := m.server, m.stop
+	m.server, m.socketFile = nil, nil
+	m.runMu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	removeServingPlugin(m)
+	// ends ListAndWatch and the watchers first, GracefulStop waits for the streams too
+	close(stop)
+	gracefulStop(server, m.stopTimeout)
+
+	return m.cleanup()
+}
+
+// gracefulStop stops server once its in-flight calls return, or aborts them
+// after timeout.
+func gracefulStop(server *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		server.Stop()
+		<-done
+	}
+}
+
+// Drain reports all the devices unhealthy to kubelet, so that no more pods
+// get them while the plugin is shutting down.
+func (m *pluginServer) Drain() {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+	if m.server == nil || m.draining {
+		return
+	}
+	m.draining = true
+	close(m.drain)
+}
+
+// running returns the channels of the current run, closed by Stop and Drain.
+// They are nil before Start, so a stray ListAndWatch blocks until its stream ends.
+func (m *pluginServer) running() (stop, drain <-chan interface{}) {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+	return m.stop, m.drain
+}
+
+// listAndWatch sends the devices of registry to kubelet on every change, all
+// unhealthy once draining, until the plugin stops. Each stream has its own
+// subscription, so concurrent streams all get every update.
+func (m *pluginServer) listAndWatch(registry *deviceRegistry, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	stop, drain := m.running()
+	sub := registry.subscribe()
+	defer registry.unsubscribe(sub)
+
+	// the subscription starts with the current devices
+	devs := (<-sub.updates).devices
+	for {
+		if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: m.advertised(devs)}); err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-s.Context().Done():
+			// kubelet went away, it opens a new stream when it comes back
+			return nil
+		case <-drain:
+			drain = nil
+		case snap := <-sub.updates:
+			devs = snap.devices
+		}
+	}
+}
+
+// advertised returns devs as sent to kubelet: all unhealthy once draining.
+func (m *pluginServer) advertised(devs []*pluginapi.Device) []*pluginapi.Device {
+	m.runMu.Lock()
+	draining := m.draining
+	m.runMu.Unlock()
+	if !draining {
+		return devs
+	}
+	unhealthy := make([]*pluginapi.Device, 0, len(devs))
+	for _, d := range devs {
+		unhealthy = append(unhealthy, &pluginapi.Device{ID: d.ID, Health: pluginapi.Unhealthy, Topology: d.Topology})
+	}
+	return unhealthy
+}
+
+// Register registers the device plugin for the given resourceName with Kubelet.
+func (m *pluginServer) Register(kubeletEndpoint, resourceName string) error {
+	conn, err := dial(kubeletEndpoint, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := pluginapi.NewRegistrationClient(conn)
+	reqt := &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     path.Base(m.socket),
+		ResourceName: resourceName,
+	}
+
+	_, err = client.Register(context.Background(), reqt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Serve starts the gRPC server and register the device plugin to Kubelet
+func (m *pluginServer) Serve() error {
+	err := m.Start()
+	if err != nil {
+		log.Printf("Could not start device plugin %s: %s", m.resourceName, err)
+		return err
+	}
+	log.Println("Starting to serve on", m.socket)
+
+	registrations.WithLabelValues(m.resourceName).Inc()
+	err = m.Register(m.kubeletSocket, m.resourceName)
+	if err != nil {
+		registrationFailures.WithLabelValues(m.resourceName).Inc()
+		log.Printf("Could not register device plugin %s: %s", m.resourceName, err)
+		m.Stop()
+		return err
+	}
+	log.Printf("Registered device plugin %s with Kubelet", m.resourceName)
+
+	return nil
+}
+
+// CheckSocket returns an error when the socket created by Start was removed
+// or replaced, as kubelet does with the plugin sockets when it restarts.
+func (m *pluginServer) CheckSocket() error {
+	m.runMu.Lock()
+	socketFile := m.socketFile
+	m.runMu.Unlock()
+	if socketFile == nil {
+		return nil
+	}
+	fi, err := os.Stat(m.socket)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, socketFile) {
+		return fmt.Errorf("%s was replaced", m.socket)
+	}
+	return nil
+}
+
+func (m *pluginServer) cleanup() error {
+	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
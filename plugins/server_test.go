@@ -0,0 +1,91 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPluginServer_CheckSocket(t *testing.T) {
+	Convey("Test socket check", t, func() {
+		p, err := NewGenericDevicePlugin(GenericSpec{Name: "tun", Resource: Resource{ResourceName: "tun"}, Devices: []DeviceMount{{HostPath: "/dev/net/tun"}}, Slots: 1})
+		So(err, ShouldBeNil)
+		m := p.(*GenericDevicePlugin)
+		m.SetPaths(Paths{PluginDir: t.TempDir()})
+
+		So(m.CheckSocket(), ShouldBeNil)
+		So(m.Start(), ShouldBeNil)
+		defer m.Stop()
+		So(m.CheckSocket(), ShouldBeNil)
+
+		Convey("removed", func() {
+			So(os.Remove(m.socket), ShouldBeNil)
+			So(m.CheckSocket(), ShouldNotBeNil)
+		})
+
+		Convey("replaced", func() {
+			So(os.Remove(m.socket), ShouldBeNil)
+			l, err := net.Listen("unix", m.socket)
+			So(err, ShouldBeNil)
+			defer l.Close()
+			So(m.CheckSocket(), ShouldNotBeNil)
+		})
+
+		Convey("stopped", func() {
+			So(m.Stop(), ShouldBeNil)
+			So(m.CheckSocket(), ShouldBeNil)
+		})
+	})
+}
+
+func TestPluginServer_Stop(t *testing.T) {
+	Convey("Test stopping and starting again", t, func() {
+		p, err := NewFuseDevicePlugin(FuseSpec{SlotSpec: SlotSpec{Slots: 1, Health: HealthSpec{Interval: "1h"}, DevRoot: t.TempDir()}})
+		So(err, ShouldBeNil)
+		m := p.(*FuseDevicePlugin)
+		m.SetPaths(Paths{PluginDir: t.TempDir()})
+
+		So(m.Stop(), ShouldBeNil)
+		So(m.Start(), ShouldBeNil)
+		first, _ := m.running()
+		So(m.Stop(), ShouldBeNil)
+		So(m.Stop(), ShouldBeNil)
+		So(closed(first), ShouldBeTrue)
+		_, err = os.Stat(m.socket)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		So(m.Start(), ShouldBeNil)
+		second, _ := m.running()
+		So(closed(second), ShouldBeFalse)
+		So(m.Start(), ShouldBeNil)
+		So(closed(second), ShouldBeTrue)
+		So(m.Stop(), ShouldBeNil)
+	})
+}
+
+func closed(ch <-chan interface{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
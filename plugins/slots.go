@@ -0,0 +1,286 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// allocationGracePeriod is how long a slot handed out by Allocate is kept
+// allocated when the PodResources API does not list it yet: the list may have
+// been taken before the allocation.
+const allocationGracePeriod = time.Minute
+
+// charDevice is a host character device node shared by slots, e.g. /dev/fuse.
+type charDevice struct {
+	// name prefixes the IDs of the slots
+	name string
+	// path is relative to /dev, e.g. net/tun
+	path         string
+	major, minor uint32
+}
+
+// SlotSpec configures a host character device shared through a number of
+// slots, the common part of FuseSpec and TunSpec.
+type SlotSpec struct {
+	Resource   `json:",inline"`
+	SocketName string `json:"socketName,omitempty"`
+	// Slots is the number of containers that can use the device at the same time.
+	Slots  int        `json:"slots,omitempty"`
+	Health HealthSpec `json:"health,omitempty"`
+	// DevRoot is where the host /dev is mounted, defaults to /dev.
+	DevRoot string `json:"devRoot,omitempty"`
+	// AllocationPolicy is the policy of GetPreferredAllocation: pack or
+	// spread. kubelet picks the devices itself when it is empty.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
+}
+
+// validate checks the spec and fills in the defaults of the device.
+func (s *SlotSpec) validate(defaultName, defaultSocket string, defaultSlots int) error {
+	if err := s.Resource.validate(defaultName); err != nil {
+		return err
+	}
+	if s.SocketName == "" {
+		s.SocketName = defaultSocket
+	}
+	if s.Slots == 0 {
+		s.Slots = defaultSlots
+	}
+	if s.Slots < 0 {
+		return fmt.Errorf("%s slots must be positive, got %d", defaultName, s.Slots)
+	}
+	if s.DevRoot == "" {
+		s.DevRoot = defaultDevRoot
+	}
+	if err := validateAllocationPolicy(s.AllocationPolicy, false); err != nil {
+		return err
+	}
+	return s.Health.Validate()
+}
+
+// slotDevicePlugin advertises a number of slots over one host character
+// device, so that as many containers can use the device without being
+// privileged. It is the common part of FuseDevicePlugin and TunDevicePlugin.
+type slotDevicePlugin struct {
+	*pluginServer
+	device charDevice
+	spec   SlotSpec
+
+	// mu protects the fields below
+	mu sync.Mutex
+	// slots is the current number of slots, it can be changed with Resize
+	slots int
+	// health is the one of the host device, shared by all the slots
+	health string
+	// allocated are the slots handed out by Allocate or listed by the
+	// PodResources API, and not released yet
+	allocated map[string]bool
+	// recent are the slots handed out by Allocate within allocationGracePeriod
+	recent map[string]time.Time
+	// tracked is set once the PodResources API listed the allocations, before
+	// that the slots allocated before a restart of the plugin are unknown
+	tracked bool
+
+	registry *deviceRegistry
+}
+
+var _ AllocationObserver = &slotDevicePlugin{}
+var _ Resizer = &slotDevicePlugin{}
+
+func newSlotDevicePlugin(device charDevice, spec SlotSpec) *slotDevicePlugin {
+	m := &slotDevicePlugin{
+		device:    device,
+		spec:      spec,
+		slots:     spec.Slots,
+		health:    pluginapi.Healthy,
+		allocated: map[string]bool{},
+		recent:    map[string]time.Time{},
+		registry:  newDeviceRegistry(nil),
+	}
+	m.syncDevices()
+	m.pluginServer = newPluginServer(spec.ResourceName, spec.SocketName, m)
+	return m
+}
+
+// ListAndWatch lists devices and update that list according to the health status
+func (m *slotDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return m.listAndWatch(m.registry, s)
+}
+
+// devices returns a copy of the advertised devices.
+func (m *slotDevicePlugin) devices() []*pluginapi.Device {
+	return m.registry.snapshot().devices
+}
+
+// healthcheck periodically checks the host device, all the slots are
+// unhealthy when it is missing or unusable.
+func (m *slotDevicePlugin) healthcheck(stop <-chan interface{}) {
+	ticker := time.NewTicker(m.spec.Health.interval())
+	defer ticker.Stop()
+
+	for {
+		m.updateHealth(checkCharDevice(filepath.Join(m.spec.DevRoot, m.device.path), m.device.major, m.device.minor))
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateHealth sets the health of every slot from the result of the host device check.
+func (m *slotDevicePlugin) updateHealth(err error) {
+	health := pluginapi.Healthy
+	if err != nil {
+		health = pluginapi.Unhealthy
+	}
+
+	m.mu.Lock()
+	if m.health == health {
+		m.mu.Unlock()
+		return
+	}
+	m.health = health
+	m.syncDevices()
+	m.mu.Unlock()
+
+	if err != nil {
+		log.Printf("%s devices are unhealthy: %s", m.resourceName, err)
+	} else {
+		log.Printf("%s devices are healthy again", m.resourceName)
+	}
+}
+
+// Resize changes the number of slots without re-registering the plugin. When
+// shrinking, the slots still allocated to pods are kept but reported unhealthy
+// until they are released. A shrink is refused until the allocations were
+// listed by the PodResources API.
+func (m *slotDevicePlugin) Resize(slots int) error {
+	if slots <= 0 {
+		return fmt.Errorf("%s slots must be positive, got %d", m.device.name, slots)
+	}
+
+	m.mu.Lock()
+	if slots < m.slots && !m.tracked {
+		m.mu.Unlock()
+		return fmt.Errorf("cannot shrink %s to %d slots: the allocated slots are unknown until listed by the PodResources API", m.resourceName, slots)
+	}
+	m.slots = slots
+	changed := m.syncDevices()
+	m.mu.Unlock()
+
+	if changed {
+		log.Printf("%s resized to %d slots", m.resourceName, slots)
+	}
+	return nil
+}
+
+// UpdateAllocations sets the slots used by the pods, along with the ones
+// recently handed out by Allocate. The slots beyond the current number of
+// slots are removed once released.
+func (m *slotDevicePlugin) UpdateAllocations(allocations Allocations) {
+	m.mu.Lock()
+	m.tracked = true
+	m.allocated = map[string]bool{}
+	for id := range allocations[m.resourceName] {
+		m.allocated[id] = true
+	}
+	for id, at := range m.recent {
+		if time.Since(at) >= allocationGracePeriod {
+			delete(m.recent, id)
+			continue
+		}
+		m.allocated[id] = true
+	}
+	m.syncDevices()
+	m.mu.Unlock()
+}
+
+// syncDevices updates the registry from the number of slots, the health of
+// the host device and the allocated slots, and returns whether it changed.
+// m.mu must be held.
+func (m *slotDevicePlugin) syncDevices() bool {
+	devs := getSlotDevices(m.device.name, m.slots)
+	current := map[string]bool{}
+	for _, d := range devs {
+		d.Health = m.health
+		current[d.ID] = true
+	}
+	// slots removed by a shrink stay until the pods using them are gone
+	for _, d := range m.registry.snapshot().devices {
+		if !current[d.ID] && m.allocated[d.ID] {
+			devs = append(devs, &pluginapi.Device{ID: d.ID, Health: pluginapi.Unhealthy})
+		}
+	}
+	return m.registry.set(devs)
+}
+
+// Allocate which return list of devices.
+func (m *slotDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	var responses pluginapi.AllocateResponse
+	path := filepath.Join("/dev", m.device.path)
+
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			log.Printf("Allocate device: %s", id)
+			if _, ok := m.registry.get(id); !ok {
+				return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
+			}
+		}
+		m.mu.Lock()
+		for _, id := range req.DevicesIDs {
+			m.allocated[id] = true
+			m.recent[id] = time.Now()
+		}
+		m.mu.Unlock()
+		response := new(pluginapi.ContainerAllocateResponse)
+		response.Devices = []*pluginapi.DeviceSpec{
+			{
+				ContainerPath: path,
+				HostPath:      path,
+				Permissions:   "rwm",
+			},
+		}
+
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+
+	return &responses, nil
+}
+
+func (m *slotDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{GetPreferredAllocationAvailable: m.spec.AllocationPolicy != ""}, nil
+}
+
+func (m *slotDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+func (m *slotDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	var devs []allocatable
+	for _, d := range m.devices() {
+		devs = append(devs, allocatableDevice(d))
+	}
+	return preferredAllocation(m.spec.AllocationPolicy, devs, reqs), nil
+}
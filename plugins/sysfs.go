@@ -0,0 +1,253 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sectorSize is the unit of the sysfs size attribute, whatever the logical block size.
+const sectorSize = 512
+
+// BlockDevice is a whole disk discovered in sysfs.
+type BlockDevice struct {
+	Name string
+	// Dev is the "major:minor" number of the device node.
+	Dev string
+	// SysPath is the resolved /sys/devices path of the disk.
+	SysPath string
+	// Controller is the PCI address of the controller (HBA) of the disk.
+	Controller string
+	// NUMANode is the NUMA node of the disk, -1 when unknown.
+	NUMANode   int
+	Size       uint64
+	Rotational bool
+	Removable  bool
+	ReadOnly   bool
+	Model      string
+	Vendor     string
+	Serial     string
+	WWN        string
+	Partitions []BlockPartition
+	Holders    []string
+	// ByID and ByPath are the names of the /dev/disk/by-id and /dev/disk/by-path links to the disk.
+	ByID   []string
+	ByPath []string
+}
+
+// BlockPartition is a partition of a BlockDevice.
+type BlockPartition struct {
+	Name    string
+	Dev     string
+	Size    uint64
+	Holders []string
+}
+
+// discoverBlockDevices lists the physical disks of the sysfs tree mounted at
+// sysfsRoot. Virtual devices (loop, ram, dm, md, zram...) are skipped.
+func discoverBlockDevices(sysfsRoot string) ([]*BlockDevice, error) {
+	entries, err := os.ReadDir(filepath.Join(sysfsRoot, "block"))
+	if err != nil {
+		return nil, err
+	}
+	var devices []*BlockDevice
+	for _, e := range entries {
+		d, err := readBlockDevice(sysfsRoot, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(d.SysPath, "/devices/virtual/") {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+// readBlockDevice reads the attributes of the disk name from sysfs.
+func readBlockDevice(sysfsRoot, name string) (*BlockDevice, error) {
+	dir := filepath.Join(sysfsRoot, "block", name)
+	sysPath, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := &BlockDevice{
+		Name:       name,
+		SysPath:    sysPath,
+		Controller: pciController(sysPath),
+		NUMANode:   numaNode(sysfsRoot, dir, sysPath),
+		Dev:        readSysfsString(dir, "dev"),
+		Size:       readSysfsUint(dir, "size") * sectorSize,
+		Rotational: readSysfsString(dir, "queue/rotational") == "1",
+		Removable:  readSysfsString(dir, "removable") == "1",
+		ReadOnly:   readSysfsString(dir, "ro") == "1",
+		Model:      readSysfsString(dir, "device/model"),
+		Vendor:     readSysfsString(dir, "device/vendor"),
+		// scsi and nvme disks expose the serial on the device, virtio on the disk
+		Serial:  firstSysfsString(dir, "device/serial", "serial"),
+		WWN:     firstSysfsString(dir, "wwid", "device/wwid"),
+		Holders: readSysfsDir(dir, "holders"),
+	}
+
+	parts, err := getPartitions(sysfsRoot, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		partDir := filepath.Join(sysfsRoot, "class", "block", part)
+		d.Partitions = append(d.Partitions, BlockPartition{
+			Name:    part,
+			Dev:     readSysfsString(partDir, "dev"),
+			Size:    readSysfsUint(partDir, "size") * sectorSize,
+			Holders: readSysfsDir(partDir, "holders"),
+		})
+	}
+	return d, nil
+}
+
+// pciAddress matches a PCI device in a sysfs path, e.g. 0000:3b:00.0
+var pciAddress = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// pciController returns the address of the last PCI device in the sysfs path
+// of a disk, the controller it is attached to, e.g. 0000:3b:00.0 for
+// /sys/devices/pci0000:3a/0000:3a:00.0/0000:3b:00.0/host0/.../block/sda.
+func pciController(sysPath string) string {
+	controller := ""
+	for _, p := range strings.Split(sysPath, "/") {
+		if pciAddress.MatchString(p) {
+			controller = p
+		}
+	}
+	return controller
+}
+
+// numaNode returns the NUMA node of the disk at dir, read from its device or
+// from the closest parent that has one, usually the PCI controller. It is -1
+// when unknown, e.g. on a machine with a single node.
+func numaNode(sysfsRoot, dir, sysPath string) int {
+	if node, ok := readNUMANode(filepath.Join(dir, "device")); ok {
+		return node
+	}
+	devices := filepath.Join(sysfsRoot, "devices")
+	if resolved, err := filepath.EvalSymlinks(devices); err == nil {
+		devices = resolved
+	}
+	for p := filepath.Dir(sysPath); strings.HasPrefix(p, devices+"/"); p = filepath.Dir(p) {
+		if node, ok := readNUMANode(p); ok {
+			return node
+		}
+	}
+	return -1
+}
+
+// readNUMANode reads the numa_node attribute of a sysfs device directory.
+func readNUMANode(dir string) (int, bool) {
+	node, err := strconv.Atoi(readSysfsString(dir, "numa_node"))
+	if err != nil || node < 0 {
+		return -1, false
+	}
+	return node, true
+}
+
+// getPartitions returns the partitions of disk, the subdirectories of
+// <sysfs>/block/<disk> that are partitions in <sysfs>/class/block.
+func getPartitions(sysfsRoot, disk string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(sysfsRoot, "block", disk))
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(sysfsRoot, "class", "block", e.Name(), "partition")); err == nil {
+			parts = append(parts, e.Name())
+		}
+	}
+	return parts, nil
+}
+
+// readDiskLinks fills in the /dev/disk/by-id and /dev/disk/by-path links of
+// the devices, found under devRoot.
+func readDiskLinks(devRoot string, devices []*BlockDevice) {
+	byName := map[string]*BlockDevice{}
+	for _, d := range devices {
+		byName[d.Name] = d
+	}
+	for _, kind := range []string{"by-id", "by-path"} {
+		dir := filepath.Join(devRoot, "disk", kind)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			target, err := os.Readlink(filepath.Join(dir, e.Name()))
+			if err != nil {
+				continue
+			}
+			d, ok := byName[filepath.Base(target)]
+			if !ok {
+				continue
+			}
+			if kind == "by-id" {
+				d.ByID = append(d.ByID, e.Name())
+			} else {
+				d.ByPath = append(d.ByPath, e.Name())
+			}
+		}
+	}
+}
+
+// readSysfsString returns the trimmed content of the attribute, or "" if it cannot be read.
+func readSysfsString(dir, attr string) string {
+	data, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func firstSysfsString(dir string, attrs ...string) string {
+	for _, attr := range attrs {
+		if v := readSysfsString(dir, attr); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func readSysfsUint(dir, attr string) uint64 {
+	v, _ := strconv.ParseUint(readSysfsString(dir, attr), 10, 64)
+	return v
+}
+
+// readSysfsDir returns the entries of a sysfs directory such as holders.
+func readSysfsDir(dir, attr string) []string {
+	entries, err := os.ReadDir(filepath.Join(dir, attr))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
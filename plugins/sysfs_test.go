@@ -0,0 +1,190 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeDisk describes a disk of a fake sysfs tree.
+type fakeDisk struct {
+	name string
+	// path is the parent of the disk under devices/, e.g. "pci0000:00/0000:00:1f.2/ata1"
+	path  string
+	attrs map[string]string
+	// parts maps the partition names to their attributes
+	parts map[string]map[string]string
+}
+
+// newFakeSysfs builds a sysfs tree with the same block and class/block
+// symlinks as the kernel and returns its root.
+func newFakeSysfs(t *testing.T, disks ...fakeDisk) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"block", "class/block"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range disks {
+		addFakeDisk(t, root, d)
+	}
+	return root
+}
+
+// addFakeDisk adds a disk to the fake sysfs tree at root.
+func addFakeDisk(t *testing.T, root string, d fakeDisk) {
+	t.Helper()
+	diskDir := filepath.Join(root, "devices", d.path, "block", d.name)
+	writeFile(t, filepath.Join(diskDir, "uevent"), "DEVTYPE=disk")
+	for attr, v := range d.attrs {
+		writeFile(t, filepath.Join(diskDir, attr), v)
+	}
+	symlink(t, diskDir, filepath.Join(root, "block", d.name))
+	symlink(t, diskDir, filepath.Join(root, "class", "block", d.name))
+	for part, attrs := range d.parts {
+		partDir := filepath.Join(diskDir, part)
+		writeFile(t, filepath.Join(partDir, "partition"), "1")
+		for attr, v := range attrs {
+			writeFile(t, filepath.Join(partDir, attr), v)
+		}
+		symlink(t, partDir, filepath.Join(root, "class", "block", part))
+	}
+}
+
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	rel, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(rel, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_discoverBlockDevices(t *testing.T) {
+	root := newFakeSysfs(t,
+		fakeDisk{
+			name: "sda",
+			path: "pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0",
+			attrs: map[string]string{
+				"dev":              "8:0\n",
+				"size":             "1953525168\n",
+				"queue/rotational": "1\n",
+				"removable":        "0\n",
+				"ro":               "0\n",
+				"device/model":     "ST1000DM010-2EP1\n",
+				"device/vendor":    "ATA     \n",
+				"device/wwid":      "naa.5000c500a1b2c3d4\n",
+			},
+			parts: map[string]map[string]string{
+				"sda1": {"dev": "8:1", "size": "2048"},
+				"sda2": {"dev": "8:2", "size": "4096", "holders/dm-0/dev": "253:0"},
+			},
+		},
+		fakeDisk{
+			name: "nvme0n1",
+			path: "pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0",
+			attrs: map[string]string{
+				"dev":              "259:0",
+				"size":             "1000215216",
+				"queue/rotational": "0",
+				"device/model":     "Samsung SSD 970 EVO Plus 500GB",
+				"device/serial":    "S4EVNX0N123456",
+				"wwid":             "eui.0025385b71b2c3d4",
+			},
+		},
+		fakeDisk{
+			name:  "vda",
+			path:  "pci0000:00/0000:00:05.0/virtio2",
+			attrs: map[string]string{"dev": "252:0", "size": "20971520", "serial": "vol-0123"},
+		},
+		fakeDisk{
+			name:  "loop0",
+			path:  "virtual",
+			attrs: map[string]string{"dev": "7:0"},
+		},
+	)
+
+	Convey("Test sysfs block device discovery", t, func() {
+		devices, err := discoverBlockDevices(root)
+		So(err, ShouldBeNil)
+		So(devices, ShouldHaveLength, 3)
+
+		nvme, sda, vda := devices[0], devices[1], devices[2]
+		So(sda.Name, ShouldEqual, "sda")
+		So(sda.Dev, ShouldEqual, "8:0")
+		So(sda.Size, ShouldEqual, uint64(1953525168*512))
+		So(sda.Rotational, ShouldBeTrue)
+		So(sda.Removable, ShouldBeFalse)
+		So(sda.Model, ShouldEqual, "ST1000DM010-2EP1")
+		So(sda.Vendor, ShouldEqual, "ATA")
+		So(sda.WWN, ShouldEqual, "naa.5000c500a1b2c3d4")
+		So(sda.Holders, ShouldBeEmpty)
+		So(sda.Partitions, ShouldResemble, []BlockPartition{
+			{Name: "sda1", Dev: "8:1", Size: 2048 * 512},
+			{Name: "sda2", Dev: "8:2", Size: 4096 * 512, Holders: []string{"dm-0"}},
+		})
+
+		So(nvme.Name, ShouldEqual, "nvme0n1")
+		So(nvme.Rotational, ShouldBeFalse)
+		So(nvme.Serial, ShouldEqual, "S4EVNX0N123456")
+		So(nvme.WWN, ShouldEqual, "eui.0025385b71b2c3d4")
+		So(nvme.Partitions, ShouldBeEmpty)
+
+		So(vda.Serial, ShouldEqual, "vol-0123")
+	})
+}
+
+func Test_pciController(t *testing.T) {
+	Convey("Test pciController", t, func() {
+		So(pciController("/sys/devices/pci0000:3a/0000:3a:00.0/0000:3b:00.0/host0/target0:0:1/0:0:1:0/block/sdb"), ShouldEqual, "0000:3b:00.0")
+		So(pciController("/sys/devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0/nvme0n1"), ShouldEqual, "0000:3d:00.0")
+		So(pciController("/sys/devices/platform/host0/block/sda"), ShouldEqual, "")
+	})
+}
+
+func Test_numaNode(t *testing.T) {
+	root := newFakeSysfs(t,
+		fakeDisk{name: "nvme0n1", path: "pci0000:80/0000:80:01.0/0000:81:00.0/nvme/nvme0", attrs: map[string]string{"device/numa_node": "1\n"}},
+		fakeDisk{name: "sda", path: "pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0"},
+		fakeDisk{name: "vda", path: "pci0000:00/0000:00:05.0/virtio2"},
+		fakeDisk{name: "sdb", path: "platform/host1/target1:0:0/1:0:0:0"},
+	)
+	writeFile(t, filepath.Join(root, "devices", "pci0000:00", "0000:00:1f.2", "numa_node"), "0\n")
+	writeFile(t, filepath.Join(root, "devices", "pci0000:00", "0000:00:05.0", "numa_node"), "-1\n")
+
+	Convey("Test numaNode", t, func() {
+		disks, err := discoverBlockDevices(root)
+		So(err, ShouldBeNil)
+		nodes := map[string]int{}
+		for _, d := range disks {
+			nodes[d.Name] = d.NUMANode
+		}
+		So(nodes, ShouldResemble, map[string]int{"nvme0n1": 1, "sda": 0, "vda": -1, "sdb": -1})
+
+		Convey("topology", func() {
+			So(blockPluginDevice(&BlockDevice{Name: "nvme0n1", NUMANode: 1}).Topology.Nodes[0].ID, ShouldEqual, 1)
+			So(blockPluginDevice(&BlockDevice{Name: "vda", NUMANode: -1}).Topology, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,54 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+const (
+	tunResourceName = "tun"
+	tunSocketName   = "tun.sock"
+	defaultTunSlots = 1000
+	// tunMajor and tunMinor are the numbers of the /dev/net/tun character device
+	tunMajor = 10
+	tunMinor = 200
+)
+
+// TunSpec configures TunDevicePlugin. Its slots are the maximum number of
+// containers using /dev/net/tun at once.
+type TunSpec struct {
+	SlotSpec `json:",inline"`
+}
+
+// Validate checks the spec and fills in the defaults.
+func (s *TunSpec) Validate() error {
+	return s.SlotSpec.validate(tunResourceName, tunSocketName, defaultTunSlots)
+}
+
+// TunDevicePlugin exposes /dev/net/tun through a number of slots, e.g. to VPN
+// sidecars creating their tunnel interface without being privileged.
+type TunDevicePlugin struct {
+	*slotDevicePlugin
+}
+
+var _ DevicePlugin = &TunDevicePlugin{}
+var _ AllocationObserver = &TunDevicePlugin{}
+
+func NewTunDevicePlugin(spec TunSpec) (DevicePlugin, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	device := charDevice{name: "tun", path: "net/tun", major: tunMajor, minor: tunMinor}
+	return &TunDevicePlugin{newSlotDevicePlugin(device, spec.SlotSpec)}, nil
+}
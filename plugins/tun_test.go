@@ -0,0 +1,78 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/zwwhdls/node-device-plugin/plugins/kubelettest"
+)
+
+func TestTunSpec_Validate(t *testing.T) {
+	Convey("Test tun spec", t, func() {
+		s := TunSpec{}
+		So(s.Validate(), ShouldBeNil)
+		So(s.ResourceName, ShouldEqual, "hdls.me/tun")
+		So(s.SocketName, ShouldEqual, "tun.sock")
+		So(s.Slots, ShouldEqual, defaultTunSlots)
+		So(s.DevRoot, ShouldEqual, "/dev")
+
+		s = TunSpec{SlotSpec: SlotSpec{Slots: -1}}
+		So(s.Validate(), ShouldNotBeNil)
+		s = TunSpec{SlotSpec: SlotSpec{AllocationPolicy: SameControllerPolicy}}
+		So(s.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestTunDevicePlugin(t *testing.T) {
+	Convey("Test tun device plugin", t, func() {
+		// no net/tun in the fake /dev
+		devRoot := t.TempDir()
+		p, err := NewTunDevicePlugin(TunSpec{SlotSpec: SlotSpec{Slots: 2, DevRoot: devRoot, Health: HealthSpec{Interval: "1h"}}})
+		So(err, ShouldBeNil)
+		m := p.(*TunDevicePlugin)
+
+		devs := m.devices()
+		So(devs, ShouldHaveLength, 2)
+		So(devs[0].ID, ShouldStartWith, "tun-")
+		So(kubelettest.Healthy(devs), ShouldHaveLength, 2)
+
+		resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{devs[1].ID}}},
+		})
+		So(err, ShouldBeNil)
+		So(resp.ContainerResponses[0].Devices, ShouldResemble, []*pluginapi.DeviceSpec{
+			{ContainerPath: "/dev/net/tun", HostPath: "/dev/net/tun", Permissions: "rwm"},
+		})
+
+		stop := make(chan interface{})
+		go m.healthcheck(stop)
+		defer close(stop)
+		deadline := time.Now().Add(5 * time.Second)
+		for len(kubelettest.Healthy(m.devices())) != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(kubelettest.Healthy(m.devices()), ShouldBeEmpty)
+		So(checkCharDevice(filepath.Join(devRoot, "net", "tun"), tunMajor, tunMinor), ShouldNotBeNil)
+	})
+}
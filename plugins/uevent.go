@@ -0,0 +1,143 @@
+/*
+  Copyright 2023 node.device.plugin
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Uevent is a kernel uevent, e.g. a disk being attached.
+type Uevent struct {
+	// Action is add, remove, change, online...
+	Action    string
+	Subsystem string
+	// DevType is disk or partition for the block subsystem.
+	DevType string
+	// DevName is the device node name relative to /dev, e.g. sdb.
+	DevName string
+	DevPath string
+}
+
+// ResyncAction is the action of the event delivered by a UeventSource when
+// uevents were lost: the devices must be rescanned.
+const ResyncAction = "resync"
+
+// UeventSource delivers the kernel uevents until it is closed.
+type UeventSource interface {
+	Events() <-chan Uevent
+	Close() error
+}
+
+// netlinkUeventSource reads the uevents broadcast by the kernel on a
+// NETLINK_KOBJECT_UEVENT socket.
+type netlinkUeventSource struct {
+	file   *os.File
+	events chan Uevent
+}
+
+func newNetlinkUeventSource() (UeventSource, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// group 1 is the kernel broadcast group, udev re-broadcasts on group 2
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	s := &netlinkUeventSource{
+		// a non-blocking file goes through the runtime poller, so Close unblocks Read
+		file:   os.NewFile(uintptr(fd), "uevent"),
+		events: make(chan Uevent),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *netlinkUeventSource) run() {
+	defer close(s.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.file.Read(buf)
+		if errors.Is(err, unix.ENOBUFS) {
+			// the socket buffer overflowed during a burst of uevents, e.g. many
+			// disks attached at once, the socket is still usable
+			log.Printf("uevents lost: %s", err)
+			s.events <- Uevent{Action: ResyncAction}
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Could not read uevents: %s", err)
+			}
+			return
+		}
+		if e, ok := parseUevent(buf[:n]); ok {
+			s.events <- e
+		}
+	}
+}
+
+func (s *netlinkUeventSource) Events() <-chan Uevent {
+	return s.events
+}
+
+func (s *netlinkUeventSource) Close() error {
+	err := s.file.Close()
+	// drain the event being delivered so that run can exit
+	go func() {
+		for range s.events {
+		}
+	}()
+	return err
+}
+
+// parseUevent decodes a kernel uevent message:
+// "add@/devices/...\x00ACTION=add\x00DEVPATH=/devices/...\x00SUBSYSTEM=block\x00..."
+func parseUevent(msg []byte) (Uevent, bool) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) == 0 || !bytes.Contains(fields[0], []byte("@")) {
+		// not a kernel message, e.g. a libudev one
+		return Uevent{}, false
+	}
+	e := Uevent{}
+	for _, f := range fields[1:] {
+		kv := bytes.SplitN(f, []byte("="), 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := string(kv[1])
+		switch string(kv[0]) {
+		case "ACTION":
+			e.Action = v
+		case "SUBSYSTEM":
+			e.Subsystem = v
+		case "DEVTYPE":
+			e.DevType = v
+		case "DEVNAME":
+			e.DevName = v
+		case "DEVPATH":
+			e.DevPath = v
+		}
+	}
+	return e, e.Action != ""
+}